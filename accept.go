@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Backoff between accept retries, as done by http.Server for temporary errors.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// retryListener keeps accepting connections after transient errors, such as
+// running out of file descriptors under a connection storm, backing off in
+// between instead of stopping the server. It only gives up once closed.
+type retryListener struct {
+	net.Listener
+}
+
+func (l retryListener) Accept() (net.Conn, error) {
+	var backoff time.Duration
+	for {
+		c, err := l.Listener.Accept()
+		if err == nil || errors.Is(err, net.ErrClosed) {
+			return c, err
+		}
+
+		backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+		log.Printf("Unable to accept a connection: %v, retrying in %v", err, backoff)
+		time.Sleep(backoff)
+	}
+}
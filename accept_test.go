@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// flakyListener fails to accept a number of times before succeeding.
+type flakyListener struct {
+	net.Listener
+	failures int
+	closed   bool
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestRetryListener(t *testing.T) {
+	l := &flakyListener{failures: 3}
+	c, err := retryListener{l}.Accept()
+	if err != nil || c == nil {
+		t.Fatalf("expected a connection once the errors are gone, got %v", err)
+	}
+	c.Close()
+	if l.failures != 0 {
+		t.Errorf("expected every failure to be retried, %d left", l.failures)
+	}
+
+	l.closed = true
+	if _, err := (retryListener{l}).Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected the closed listener error, got %v", err)
+	}
+}
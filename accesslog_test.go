@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+
+	h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Nope", http.StatusTeapot)
+	}))
+	req := httptest.NewRequest("GET", "/api/devices", nil)
+	req.RemoteAddr = "80.2.3.41:321"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, field := range []string{"method=GET", "path=/api/devices", "ip=80.2.3.41", "status=418", "bytes=5", "latency="} {
+		if !strings.Contains(out.String(), field) {
+			t.Errorf("expected %s in the access log, got %q", field, out.String())
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// isAdmin reports whether the request carries the admin token, as a bearer
+// token in the Authorization header or as the basic auth password, which
+// browsers can send.
+func isAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminOnly restricts h to admin requests. The admin API doesn't exist when
+// no admin token is configured.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !isAdmin(r) {
+			http.Error(w, "Invalid admin token", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// AdminUI serves the operations dashboard from adminStaticDir, apart from
+// the public files. Browsers log in with basic auth, any user name and the
+// admin token as password, and reuse it for the admin API calls.
+func AdminUI(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" || adminStaticDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="nupnp admin"`)
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	http.StripPrefix("/admin/", http.FileServer(http.Dir(adminStaticDir))).ServeHTTP(w, r)
+}
+
+// ListExternalAddresses lists the distinct external addresses currently
+// holding devices.
+func ListExternalAddresses(w http.ResponseWriter, r *http.Request) {
+	type externalAddress struct {
+		Address string    `json:"address"`
+		Devices int       `json:"devices"`
+		Newest  time.Time `json:"newest"`
+	}
+
+	devices.RLock()
+	found := map[string]*externalAddress{}
+	for _, d := range devices.d {
+		if !d.live() {
+			continue
+		}
+		ea, ok := found[d.ExternalAddress]
+		if !ok {
+			ea = &externalAddress{Address: d.ExternalAddress}
+			found[d.ExternalAddress] = ea
+		}
+		ea.Devices++
+		if d.Added.After(ea.Newest) {
+			ea.Newest = d.Added
+		}
+	}
+	devices.RUnlock()
+
+	eas := make([]externalAddress, 0, len(found))
+	for _, ea := range found {
+		eas = append(eas, *ea)
+	}
+	sort.Slice(eas, func(i, j int) bool { return eas[i].Address < eas[j].Address })
+
+	writeJSON(w, r, eas)
+}
+
+// adminDevice is a device along with the network it was registered from,
+// which is hidden from the public API.
+type adminDevice struct {
+	ExternalAddress string `json:"externaladdress"`
+	Tenant          string `json:"tenant,omitempty"`
+	Device          Device `json:"device"`
+}
+
+// AdminListDevices lists the devices of every network, optionally only those
+// whose external address is within the "cidr" query parameter, or one of the
+// comma separated "ips", e.g. for an orchestrator managing several networks.
+// With "anonymize=true" the external addresses, and the ids derived from
+// them, are anonymized, to share the inventory.
+func AdminListDevices(w http.ResponseWriter, r *http.Request) {
+	anonymize := r.URL.Query().Get("anonymize") == "true"
+
+	var network *net.IPNet
+	if cidr := r.URL.Query().Get("cidr"); cidr != "" {
+		var err error
+		if _, network, err = net.ParseCIDR(cidr); err != nil {
+			http.Error(w, cidr+" is not a valid CIDR", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var ips map[string]bool
+	if list := r.URL.Query().Get("ips"); list != "" {
+		ips = map[string]bool{}
+		for _, ip := range strings.Split(list, ",") {
+			parsed := net.ParseIP(strings.TrimSpace(ip))
+			if parsed == nil {
+				http.Error(w, ip+" is not a valid IP address", http.StatusBadRequest)
+				return
+			}
+			ips[parsed.String()] = true
+		}
+	}
+
+	devices.RLock()
+	found := []adminDevice{}
+	for _, d := range devices.d {
+		if !d.live() {
+			continue
+		}
+		if network != nil && !network.Contains(net.ParseIP(d.ExternalAddress)) {
+			continue
+		}
+		if ips != nil && !ips[d.ExternalAddress] {
+			continue
+		}
+		if anonymize {
+			// The id is derived from the external address too.
+			d.ExternalAddress = exportIP(d.ExternalAddress)
+		}
+		found = append(found, adminDevice{d.ExternalAddress, d.Tenant, d})
+	}
+	devices.RUnlock()
+
+	writeJSON(w, r, found)
+}
+
+// AdminReset removes every device, for test environments, and saves the
+// emptied state to the dump when "truncate_dump=true" is passed. It only
+// exists with -allow-reset.
+func AdminReset(w http.ResponseWriter, r *http.Request) {
+	if !allowReset {
+		http.NotFound(w, r)
+		return
+	}
+
+	devices.Lock()
+	removed := len(devices.d)
+	setDevices(make([]Device, 0))
+	reindex()
+	changed()
+	devices.Unlock()
+	log.Println("Reset by the admin,", removed, "devices removed")
+
+	if r.URL.Query().Get("truncate_dump") == "true" && dumpPath != "" {
+		if err := saveDevices(dumpPath); err != nil {
+			log.Println("Unable to truncate the dump:", err)
+			http.Error(w, "Unable to truncate the dump", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, r, struct {
+		Removed int `json:"removed"`
+	}{removed})
+}
+
+// AdminPin pins or unpins a registered device, identified like in the
+// admin device list by its external address, tenant, internal address and
+// scope. Cleanup never removes a pinned device, even when it stops
+// registering.
+func AdminPin(w http.ResponseWriter, r *http.Request) {
+	var t struct {
+		ExternalAddress string `json:"externaladdress"`
+		Tenant          string `json:"tenant"`
+		Address         string `json:"address"`
+		Scope           string `json:"scope"`
+		Pinned          bool   `json:"pinned"`
+	}
+	if !decodeBody(w, r, &t) {
+		return
+	}
+
+	devices.Lock()
+	defer devices.Unlock()
+	i, ok := findDevice(strings.TrimSpace(t.Address), owner{t.ExternalAddress, t.Scope, t.Tenant})
+	if !ok || !devices.d[i].live() {
+		http.NotFound(w, r)
+		return
+	}
+
+	d := &devices.d[i]
+	if d.Pinned != t.Pinned {
+		d.Pinned = t.Pinned
+		changed()
+		scheduleExpiry(*d)
+		log.Println("pinned set to", t.Pinned, "for", logIP(d.InternalAddress), "by the admin")
+	}
+	writeJSON(w, r, adminDevice{d.ExternalAddress, d.Tenant, *d})
+}
+
+// redactedFlags are the flags of which AdminConfig only tells whether they
+// are set: secrets, and the webhook URLs which can carry credentials. Flags
+// whose name mentions a token, key, secret or password are redacted too, in
+// case new ones aren't listed here. The dump and archive paths are internal
+// details of the host.
+var redactedFlags = map[string]bool{
+	"admin-token":    true,
+	"sign-key":       true,
+	"webhook":        true,
+	"expiry-webhook": true,
+	"dump":           true,
+	"expire-archive": true,
+}
+
+func redactedFlag(name string) bool {
+	if redactedFlags[name] {
+		return true
+	}
+	for _, s := range []string{"token", "key", "secret", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminConfig returns the effective configuration, the value of each flag,
+// to diagnose the behavior of the service without access to the host.
+func AdminConfig(w http.ResponseWriter, r *http.Request) {
+	config := struct {
+		Flags map[string]string `json:"flags"`
+		// Proxies from which the X-Real-IP header is trusted.
+		TrustedProxies []string `json:"trusted_proxies"`
+		ProxyProtocol  bool     `json:"proxy_protocol"`
+		Draining       bool     `json:"draining"`
+	}{
+		Flags:          map[string]string{},
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+		ProxyProtocol:  proxyProtocol,
+		Draining:       draining.Load(),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if v != "" && redactedFlag(f.Name) {
+			v = "[redacted]"
+		}
+		config.Flags[f.Name] = v
+	})
+
+	writeJSON(w, r, config)
+}
@@ -0,0 +1,55 @@
+
+document.addEventListener('DOMContentLoaded', setupUI);
+function setupUI() {
+  listIPs();
+  listDevices('');
+  document.querySelector('.cidr-filter').addEventListener('submit', function(e) {
+    e.preventDefault();
+    listDevices(this.cidr.value);
+  });
+}
+
+// The browser resends the basic auth credentials used to load this page.
+function get(path, callback) {
+  var request = new XMLHttpRequest();
+  request.open('GET', path, true);
+
+  request.onload = function() {
+    if (this.status >= 200 && this.status < 400) {
+      callback(JSON.parse(this.response));
+    } else {
+      alert(this.response);
+    }
+  };
+  request.send();
+}
+
+function row(cells) {
+  var tr = document.createElement('tr');
+  cells.forEach(function(cell) {
+    var td = document.createElement('td');
+    td.textContent = cell;
+    tr.appendChild(td);
+  });
+  return tr;
+}
+
+function listIPs() {
+  get('/api/admin/ips', function(ips) {
+    var list = document.querySelector('.ip-list');
+    list.innerHTML = '';
+    ips.forEach(function(ip) {
+      list.appendChild(row([ip.address, ip.devices, new Date(ip.newest).toLocaleString()]));
+    });
+  });
+}
+
+function listDevices(cidr) {
+  get('/api/admin/devices' + (cidr ? '?cidr=' + encodeURIComponent(cidr) : ''), function(devices) {
+    var list = document.querySelector('.device-list');
+    list.innerHTML = '';
+    devices.forEach(function(d) {
+      list.appendChild(row([d.externaladdress, d.device.internaladdress, d.device.name, d.device.state, new Date(d.device.last_seen).toLocaleString()]));
+    });
+  });
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+)
+
+// anonymizeSalt is drawn on startup, so the hashes logged by one process
+// can be correlated with each other but not reversed with a lookup table.
+var anonymizeSalt = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// logIP returns the address as it should appear in logs: unchanged, or as a
+// salted hash when -anonymize-ips is set.
+func logIP(ip string) string {
+	if !anonymizeIPs {
+		return ip
+	}
+	return hashIP(ip)
+}
+
+func hashIP(ip string) string {
+	h := hmac.New(sha256.New, anonymizeSalt)
+	h.Write([]byte(ip))
+	return "ip-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// exportIP returns the address as it should appear in an anonymized export,
+// with the -anonymize-strategy: "mask" zeroes the host part (the last octet
+// of IPv4, all but the /48 of IPv6), "hash" replaces it by its salted hash,
+// as in the logs.
+func exportIP(ip string) string {
+	if anonymizeStrategy == "hash" {
+		return hashIP(ip)
+	}
+
+	parsed := net.ParseIP(ip)
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.To4() != nil:
+		return parsed.Mask(net.CIDRMask(24, 32)).String()
+	default:
+		return parsed.Mask(net.CIDRMask(48, 128)).String()
+	}
+}
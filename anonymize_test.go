@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestLogIP(t *testing.T) {
+	defer func(b bool) { anonymizeIPs = b }(anonymizeIPs)
+
+	anonymizeIPs = false
+	if ip := logIP("192.168.100.151"); ip != "192.168.100.151" {
+		t.Errorf("got %v, expected the address unchanged", ip)
+	}
+
+	anonymizeIPs = true
+	ip := logIP("192.168.100.151")
+	if ip == "192.168.100.151" || ip != logIP("192.168.100.151") || ip == logIP("192.168.100.152") {
+		t.Errorf("got %v, expected a stable hash of the address", ip)
+	}
+}
+
+func TestExportIP(t *testing.T) {
+	defer func(s string) { anonymizeStrategy = s }(anonymizeStrategy)
+
+	anonymizeStrategy = "mask"
+	for ip, expected := range map[string]string{
+		"203.0.113.42":         "203.0.113.0",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1::",
+	} {
+		if got := exportIP(ip); got != expected {
+			t.Errorf("%s: got %s want %s", ip, got, expected)
+		}
+	}
+
+	anonymizeStrategy = "hash"
+	if ip := exportIP("203.0.113.42"); ip == "203.0.113.42" || ip != exportIP("203.0.113.42") || ip == exportIP("203.0.113.43") {
+		t.Errorf("got %v, expected a stable hash of the address", ip)
+	}
+}
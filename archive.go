@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// archiver appends the devices removed by the cleanup to the -expire-archive
+// file, one JSON object per line. The file is opened on the first removal,
+// and not again during the same cleanup once that failed.
+type archiver struct {
+	f       *os.File
+	enc     *json.Encoder
+	failed  bool
+	pending []archivedDevice
+}
+
+type archivedDevice struct {
+	Expired         time.Time `json:"expired"`
+	Reason          string    `json:"reason"`
+	ExternalAddress string    `json:"externaladdress"`
+	Device          Device    `json:"device"`
+}
+
+// add queues d to be archived by the next write, it is called under the
+// devices lock.
+func (a *archiver) add(d Device, reason string) {
+	if expireArchive == "" || a.failed {
+		return
+	}
+	a.pending = append(a.pending, archivedDevice{time.Now().UTC(), reason, d.ExternalAddress, d})
+}
+
+// write archives the queued devices, outside of the devices lock. Failures
+// are only logged so they don't prevent the expiry.
+func (a *archiver) write() {
+	defer func() { a.pending = a.pending[:0] }()
+	if len(a.pending) == 0 || a.failed {
+		return
+	}
+	if a.f == nil {
+		f, err := os.OpenFile(expireArchive, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Println("Unable to open the expire archive:", err)
+			a.failed = true
+			return
+		}
+		a.f, a.enc = f, json.NewEncoder(f)
+	}
+	for _, ad := range a.pending {
+		if err := a.enc.Encode(ad); err != nil {
+			log.Println("Unable to archive", logIP(ad.Device.InternalAddress)+":", err)
+		}
+	}
+}
+
+func (a *archiver) close() {
+	if a.f == nil {
+		return
+	}
+	if err := a.f.Close(); err != nil {
+		log.Println("Unable to close the expire archive:", err)
+	}
+	a.f = nil
+}
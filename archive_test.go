@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireArchive(t *testing.T) {
+	defer func(path string) { expireArchive = path }(expireArchive)
+	expireArchive = filepath.Join(t.TempDir(), "archive.jsonl")
+
+	old := time.Now().Add(-2 * lifetime)
+	devices.Lock()
+	saved := devices.d
+	setDevices([]Device{
+		{ExternalAddress: "80.2.3.62", InternalAddress: "192.168.100.10", Name: "Expired", Added: old, LastSeen: old},
+		{ExternalAddress: "80.2.3.62", InternalAddress: "192.168.100.11", Name: "Alive", Added: time.Now(), LastSeen: time.Now()},
+	})
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		setDevices(saved)
+		devices.Unlock()
+	}()
+
+	expire()
+
+	devices.RLock()
+	if len(devices.d) != 1 || devices.d[0].Name != "Alive" {
+		t.Errorf("expected only the alive device to remain, got %v", devices.d)
+	}
+	devices.RUnlock()
+
+	f, err := os.Open(expireArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []archivedDevice
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var a archivedDevice
+		if err := json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			t.Fatalf("invalid archive line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, a)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("expected one archived device, got %v", lines)
+	}
+	if a := lines[0]; a.Reason != "timeout" || a.ExternalAddress != "80.2.3.62" || a.Device.InternalAddress != "192.168.100.10" || a.Expired.IsZero() {
+		t.Errorf("unexpected archived device %+v", a)
+	}
+}
+
+func TestExpireArchiveUnavailable(t *testing.T) {
+	defer func(path string) { expireArchive = path }(expireArchive)
+	expireArchive = filepath.Join(t.TempDir(), "missing", "archive.jsonl")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	old := time.Now().Add(-2 * lifetime)
+	devices.Lock()
+	saved := devices.d
+	var expired []Device
+	for i := 0; i < 3; i++ {
+		expired = append(expired, Device{ExternalAddress: "80.2.3.115", InternalAddress: fmt.Sprintf("192.168.100.%d", 121+i), Added: old, LastSeen: old})
+	}
+	setDevices(expired)
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		setDevices(saved)
+		devices.Unlock()
+	}()
+
+	expire()
+
+	devices.RLock()
+	if len(devices.d) != 0 {
+		t.Errorf("expected the devices to expire anyway, got %v", devices.d)
+	}
+	devices.RUnlock()
+	if n := strings.Count(logs.String(), "Unable to open the expire archive"); n != 1 {
+		t.Errorf("expected the archive to be opened once, got %d failures:\n%s", n, logs.String())
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func setBacklog(ln net.Listener, backlog int) error {
+	return errors.New("setting the listen backlog is not supported on this platform")
+}
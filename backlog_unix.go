@@ -0,0 +1,31 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setBacklog resizes the queue of connections waiting to be accepted, by
+// calling listen(2) again on the listening socket.
+func setBacklog(ln net.Listener, backlog int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return errors.New("the listener has no socket")
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = c.Control(func(fd uintptr) {
+		serr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
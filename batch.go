@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// batchOp is an operation of a batch request.
+type batchOp struct {
+	Op     string          `json:"op"`
+	Params json.RawMessage `json:"params"`
+}
+
+// batchResult is the outcome of an operation, at the same index as the
+// operation in the response.
+type batchResult struct {
+	Status int         `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+func batchError(status int, err error) batchResult {
+	return batchResult{Status: status, Error: err.Error()}
+}
+
+// Batch runs several operations in one round trip: "register" takes the
+// parameters of /api/register, "heartbeat" refreshes a registered device
+// from its "address" and "scope", and "list" returns the devices like
+// /api/devices, with optional "scope", "tags" and "location". The external
+// address is resolved once for all of them, and a failing operation doesn't
+// prevent the next ones.
+func Batch(w http.ResponseWriter, r *http.Request) {
+	var ops []batchOp
+	if !decodeBody(w, r, &ops) {
+		return
+	}
+	if len(ops) > maxBulk {
+		http.Error(w, fmt.Sprintf("At most %d operations can be sent at once", maxBulk), http.StatusBadRequest)
+		return
+	}
+
+	ea, err := externalAddress(r)
+	if err == errNoProxy {
+		log.Println(logIP(ea), "tried to send a batch, this can happen when proxy is not configured correctly.")
+		http.Error(w, `Host `+ea+` is not allowed to use the API`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	tenant := tenantOf(r)
+	admin := isAdmin(r)
+	token := r.Header.Get("X-Device-Token")
+
+	results := make([]batchResult, 0, len(ops))
+	for _, op := range ops {
+		var res batchResult
+		switch op.Op {
+		case "register":
+			res = batchRegister(op.Params, ea, tenant, admin, token)
+		case "heartbeat":
+			res = batchHeartbeat(op.Params, ea, tenant, token)
+		case "list":
+			res = batchList(op.Params, ea, tenant)
+		default:
+			res = batchError(http.StatusBadRequest, fmt.Errorf("Unknown operation %q", op.Op))
+		}
+		results = append(results, res)
+	}
+
+	writeJSON(w, r, results)
+}
+
+func batchRegister(params json.RawMessage, ea, tenant string, admin bool, token string) batchResult {
+	var t registration
+	if err := json.Unmarshal(params, &t); err != nil {
+		return batchError(http.StatusBadRequest, err)
+	}
+	if err := t.validate(); err != nil {
+		return batchError(http.StatusBadRequest, err)
+	}
+	if t.Pinned && !admin {
+		return batchError(http.StatusForbidden, errPinning)
+	}
+	if ok, retry := allowRegister(ea); !ok {
+		return batchError(http.StatusTooManyRequests, fmt.Errorf("Too many registrations, retry in %v", retry))
+	}
+
+	devices.Lock()
+	defer devices.Unlock()
+	if t.Token != "" {
+		token = t.Token
+	}
+	token, err := register(t, ea, tenant, token)
+	if err == errTooManyNetworks {
+		return batchError(http.StatusServiceUnavailable, err)
+	} else if err == errInvalidToken {
+		return batchError(http.StatusForbidden, err)
+	} else if err == errTooManyPorts {
+		return batchError(http.StatusTooManyRequests, err)
+	} else if err == errDeviceExists {
+		return batchError(http.StatusConflict, err)
+	} else if err != nil {
+		return batchError(http.StatusInternalServerError, errors.New("Unable to generate a device token"))
+	}
+
+	if token == "" {
+		return batchResult{Status: http.StatusOK}
+	}
+	return batchResult{Status: http.StatusOK, Result: map[string]string{"token": token}}
+}
+
+func batchHeartbeat(params json.RawMessage, ea, tenant, token string) batchResult {
+	var t struct {
+		Address string `json:"address"`
+		Scope   string `json:"scope"`
+		Token   string `json:"token"`
+	}
+	if err := json.Unmarshal(params, &t); err != nil {
+		return batchError(http.StatusBadRequest, err)
+	}
+	if t.Token != "" {
+		token = t.Token
+	}
+	if err := scopeError(t.Scope); err != nil {
+		return batchError(http.StatusBadRequest, err)
+	}
+	t.Address = strings.Trim(t.Address, " ")
+
+	devices.Lock()
+	defer devices.Unlock()
+	i, ok := findDevice(t.Address, owner{ea, t.Scope, tenant})
+	if !ok || !devices.d[i].live() {
+		return batchError(http.StatusNotFound, fmt.Errorf("%s is not registered", t.Address))
+	}
+	if !devices.d[i].hasToken(token) {
+		return batchError(http.StatusForbidden, errInvalidToken)
+	}
+	devices.d[i].LastSeen = time.Now().UTC()
+	devices.d[i].Extended = 0
+	changed()
+	return batchResult{Status: http.StatusOK}
+}
+
+func batchList(params json.RawMessage, ea, tenant string) batchResult {
+	var t struct {
+		Scope    string   `json:"scope"`
+		Tags     []string `json:"tags"`
+		Location string   `json:"location"`
+	}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &t); err != nil {
+			return batchError(http.StatusBadRequest, err)
+		}
+	}
+	if err := scopeError(t.Scope); err != nil {
+		return batchError(http.StatusBadRequest, err)
+	}
+
+	devices.RLock()
+	defer devices.RUnlock()
+	return batchResult{Status: http.StatusOK, Result: devicesFor(owner{ea, t.Scope, tenant}, filter{tags: t.Tags, location: t.Location})}
+}
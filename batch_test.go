@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	forget("80.2.3.68")
+	rr := post(t, Batch, "80.2.3.68:321", `[
+		{"op":"register","params":{"name":"Gateway","address":"192.168.100.35"}},
+		{"op":"heartbeat","params":{"address":"192.168.100.35"}},
+		{"op":"heartbeat","params":{"address":"192.168.100.36"}},
+		{"op":"list"},
+		{"op":"reboot"}
+	]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+
+	var results []struct {
+		Status int
+		Error  string
+		Result json.RawMessage
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 5 {
+		t.Fatalf("unexpected results %v: %v", rr.Body.String(), err)
+	}
+	// The heartbeat needs the token returned by the registration.
+	for i, status := range []int{http.StatusOK, http.StatusForbidden, http.StatusNotFound, http.StatusOK, http.StatusBadRequest} {
+		if results[i].Status != status {
+			t.Errorf("operation %d: got status %v want %v - %s", i, results[i].Status, status, results[i].Error)
+		}
+	}
+
+	var token struct{ Token string }
+	if json.Unmarshal(results[0].Result, &token); token.Token == "" {
+		t.Errorf("expected a device token, got %s", results[0].Result)
+	}
+	var list []Device
+	if err := json.Unmarshal(results[3].Result, &list); err != nil || len(list) != 1 || list[0].Name != "Gateway" {
+		t.Errorf("unexpected list %s: %v", results[3].Result, err)
+	}
+
+	rr = postToken(t, Batch, "80.2.3.68:321", token.Token, `[
+		{"op":"heartbeat","params":{"address":" 192.168.100.35 "}},
+		{"op":"register","params":{"name":"Renamed","address":"192.168.100.35"}},
+		{"op":"heartbeat","params":{"address":"192.168.100.35","scope":"`+strings.Repeat("s", maxScopeLength+1)+`"}}
+	]`)
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 3 || results[0].Status != http.StatusOK || results[1].Status != http.StatusOK {
+		t.Errorf("expected the token to allow the heartbeat and the update, got %v - %v", rr.Body, err)
+	}
+	if len(results) == 3 && results[2].Status != http.StatusBadRequest {
+		t.Errorf("expected an invalid scope to be rejected, got %v - %s", results[2].Status, results[2].Error)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// RegisterDevices registers several devices of the same network at once,
+// from a JSON array of registrations. Nothing is registered unless they are
+// all valid, and the response lists the token of each added device.
+func RegisterDevices(w http.ResponseWriter, r *http.Request) {
+	var list []registration
+	if !decodeBody(w, r, &list) {
+		return
+	}
+
+	if len(list) == 0 {
+		http.Error(w, "Please send at least one device", http.StatusBadRequest)
+		return
+	}
+	if len(list) > maxBulk {
+		http.Error(w, fmt.Sprintf("At most %d devices can be registered at once", maxBulk), http.StatusBadRequest)
+		return
+	}
+	for i := range list {
+		if err := list[i].validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Device %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if list[i].Pinned && !isAdmin(r) {
+			http.Error(w, fmt.Sprintf("Device %d: %v", i, errPinning), http.StatusForbidden)
+			return
+		}
+	}
+
+	ea, ok := registrant(w, r)
+	if !ok {
+		return
+	}
+
+	type result struct {
+		Address string `json:"address"`
+		Token   string `json:"token,omitempty"`
+	}
+	results := make([]result, 0, len(list))
+
+	// Everything register can refuse is checked first, so that no device is
+	// added, and its token lost, when a later one is refused.
+	devices.Lock()
+	ports := map[string][]int{}
+	for i, t := range list {
+		if j, ok := findDevice(t.Address, owner{ea, t.Scope, tenantOf(r)}); ok && devices.d[j].Deleted.IsZero() && !devices.d[j].hasToken(t.token(r)) {
+			devices.Unlock()
+			http.Error(w, fmt.Sprintf("Device %d: %v", i, errInvalidToken), http.StatusForbidden)
+			return
+		}
+		if t.OnlyIfAbsent && (claimed(t, owner{ea, t.Scope, tenantOf(r)}) || slices.ContainsFunc(list[:i], func(p registration) bool {
+			return p.Scope == t.Scope && (p.Address == t.Address || (t.Name != "" && p.Name == t.Name))
+		})) {
+			devices.Unlock()
+			http.Error(w, fmt.Sprintf("Device %d: %v", i, errDeviceExists), http.StatusConflict)
+			return
+		}
+		// The ports of the devices of an internal address add up.
+		ports[t.Address] = append(ports[t.Address], t.Ports...)
+		if !checkPorts(ea, t.Address, ports[t.Address]) {
+			devices.Unlock()
+			http.Error(w, fmt.Sprintf("Device %d: %v", i, errTooManyPorts), http.StatusTooManyRequests)
+			return
+		}
+	}
+	for _, t := range list {
+		token, err := register(t, ea, tenantOf(r), t.token(r))
+		if err == errTooManyNetworks {
+			devices.Unlock()
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err == errTooManyPorts {
+			devices.Unlock()
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err == errDeviceExists {
+			devices.Unlock()
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			devices.Unlock()
+			http.Error(w, "Unable to generate a device token", http.StatusInternalServerError)
+			return
+		}
+		results = append(results, result{t.Address, token})
+	}
+	devices.Unlock()
+
+	writeJSON(w, r, results)
+}
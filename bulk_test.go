@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRegisterDevices(t *testing.T) {
+	forget("80.2.3.63")
+	rr := post(t, RegisterDevices, "80.2.3.63:321", `[{"name":"One","address":"192.168.100.12"},{"name":"Two","address":"192.168.100.13","port":8080}]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+	var results []struct{ Address, Token string }
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 2 || results[1].Address != "192.168.100.13" || results[1].Token == "" {
+		t.Errorf("unexpected results %v: %v", rr.Body.String(), err)
+	}
+
+	rr = get(t, ListDevices, "80.2.3.63:321", "/api/devices")
+	if !strings.Contains(rr.Body.String(), `"name":"One"`) || !strings.Contains(rr.Body.String(), `"name":"Two"`) {
+		t.Errorf("expected both devices to be listed, got %v", rr.Body.String())
+	}
+}
+
+func TestRegisterDevicesLimits(t *testing.T) {
+	defer func(n int, size int64) { maxBulk, maxBodyBytes = n, size }(maxBulk, maxBodyBytes)
+	maxBulk = 2
+
+	var items []string
+	for i := 0; i < 3; i++ {
+		items = append(items, fmt.Sprintf(`{"name":"Device","address":"192.168.100.%d"}`, 20+i))
+	}
+	rr := post(t, RegisterDevices, "80.2.3.64:321", "["+strings.Join(items, ",")+"]")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("too many devices: got %v - %v", rr.Code, rr.Body)
+	}
+
+	rr = post(t, RegisterDevices, "80.2.3.64:321", `[{"name":"Device","address":"192.168.100.20"},{"name":"Device","address":"127.0.0.1"}]`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Device 1") {
+		t.Errorf("invalid device: got %v - %v", rr.Code, rr.Body)
+	}
+
+	maxBodyBytes = 32
+	rr = post(t, RegisterDevices, "80.2.3.64:321", "["+items[0]+"]")
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body too large: got %v - %v", rr.Code, rr.Body)
+	}
+
+	rr = get(t, ListDevices, "80.2.3.64:321", "/api/devices")
+	if strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("expected nothing to be registered, got %v", rr.Body.String())
+	}
+}
+
+func TestRegisterDevicesAtomic(t *testing.T) {
+	defer func(n int, action string) { maxPortsPerHost, portsAction = n, action }(maxPortsPerHost, portsAction)
+	maxPortsPerHost, portsAction = 2, "reject"
+
+	post(t, RegisterDevice, "80.2.3.114:321", `{"name":"Taken","address":"192.168.100.118"}`)
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`[{"name":"New","address":"192.168.100.119"},{"name":"Taken","address":"192.168.100.120","only_if_absent":true}]`, http.StatusConflict},
+		{`[{"name":"New","address":"192.168.100.119","only_if_absent":true},{"name":"New","address":"192.168.100.120","only_if_absent":true}]`, http.StatusConflict},
+		{`[{"name":"New","address":"192.168.100.119","port":[1,2]},{"name":"Other","address":"192.168.100.119","scope":"b","port":[3]}]`, http.StatusTooManyRequests},
+	} {
+		if rr := post(t, RegisterDevices, "80.2.3.114:321", c.body); rr.Code != c.code {
+			t.Errorf("%s: got %v - %v", c.body, rr.Code, rr.Body)
+		}
+		rr := get(t, ListDevices, "80.2.3.114:321", "/api/devices")
+		if strings.Contains(rr.Body.String(), `"name":"New"`) {
+			t.Fatalf("%s: expected nothing to be registered, got %v", c.body, rr.Body.String())
+		}
+	}
+}
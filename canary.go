@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The canary registers from an external address reserved for documentation
+// (RFC 5737), which no client network has, so it never shows up in their
+// listings.
+const (
+	canaryIP      = "192.0.2.1"
+	canaryAddress = "10.0.0.1"
+	canaryName    = "nupnp canary"
+	canaryScope   = "nupnp-canary"
+)
+
+var canaryDevice = Device{ExternalAddress: canaryIP, InternalAddress: canaryAddress, Name: canaryName, Scope: canaryScope}
+
+// canaryToken is the device token of the canary, needed to refresh it. Only
+// runCanary and canaryCheck use it, from a single goroutine.
+var canaryToken string
+
+// canaryKey tags the context of the canary requests, see isCanary.
+type canaryKey struct{}
+
+// isCanary tells whether r is a request of the canary, whose registrations
+// are neither counted, logged nor notified.
+func isCanary(r *http.Request) bool {
+	return r.Context().Value(canaryKey{}) != nil
+}
+
+// canaryRecorder is the response writer of the canary requests.
+type canaryRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *canaryRecorder) Header() http.Header { return c.header }
+
+func (c *canaryRecorder) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *canaryRecorder) Write(b []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.body.Write(b)
+}
+
+// canaryRequest sends a request to h the way the local proxy forwards those
+// of the canary network.
+func canaryRequest(h http.Handler, method, target, body string) *canaryRecorder {
+	req, _ := http.NewRequestWithContext(context.WithValue(context.Background(), canaryKey{}, true), method, target, strings.NewReader(body))
+	req.Header.Set("X-Device-Token", canaryToken)
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("X-Real-IP", canaryIP)
+	req.Header.Set("X-Forwarded-For", canaryIP)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := &canaryRecorder{header: http.Header{}}
+	h.ServeHTTP(rec, req)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec
+}
+
+// canaryCheck registers, or refreshes, the canary through h and checks that
+// it is listed.
+func canaryCheck(h http.Handler) error {
+	reg, _ := json.Marshal(registration{Name: canaryName, Address: canaryAddress, Scope: canaryScope})
+	rec := canaryRequest(h, http.MethodPost, "/api/register", string(reg))
+	if rec.status != http.StatusOK {
+		return fmt.Errorf("registration returned %d: %s", rec.status, strings.TrimSpace(rec.body.String()))
+	}
+	if token := rec.header.Get("X-Device-Token"); token != "" {
+		canaryToken = token
+	}
+
+	rec = canaryRequest(h, http.MethodGet, "/api/devices?scope="+canaryScope, "")
+	if rec.status != http.StatusOK {
+		return fmt.Errorf("listing returned %d: %s", rec.status, strings.TrimSpace(rec.body.String()))
+	}
+	var listed []struct {
+		InternalAddress string `json:"internaladdress"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &listed); err != nil {
+		return fmt.Errorf("unexpected listing: %v", err)
+	}
+	for _, d := range listed {
+		if d.InternalAddress == canaryAddress {
+			return nil
+		}
+	}
+	return errors.New("the canary is not listed")
+}
+
+// runCanary checks the canary through h at startup then every interval,
+// notifying the webhook with "canary_ok" or "canary_failed" each time the
+// outcome changes, starting with the first one.
+func runCanary(h http.Handler, interval time.Duration) {
+	dropCanary()
+	var checked, failing bool
+	for {
+		err := canaryCheck(h)
+		if err != nil {
+			log.Println("Canary check failed:", err)
+		}
+		if !checked || failing != (err != nil) {
+			event := "canary_ok"
+			if err != nil {
+				event = "canary_failed"
+			}
+			notify(event, canaryDevice)
+		}
+		checked, failing = true, err != nil
+		time.Sleep(interval)
+	}
+}
+
+// dropCanary removes the canary restored from the dump, whose token was lost
+// with the previous process.
+func dropCanary() {
+	devices.Lock()
+	defer devices.Unlock()
+	if i, ok := findDevice(canaryAddress, owner{canaryIP, canaryScope, ""}); ok {
+		setDevices(slices.Delete(devices.d, i, i+1))
+		reindex()
+		changed()
+	}
+}
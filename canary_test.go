@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCanary(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	if err := canaryCheck(mux); err != nil {
+		t.Fatalf("expected the canary check to pass, got %v", err)
+	}
+	if err := canaryCheck(mux); err != nil {
+		t.Fatalf("expected the canary to be refreshed, got %v", err)
+	}
+	// Other networks don't see it.
+	if rr := get(t, ListDevices, "80.2.3.106:321", "/api/devices?scope="+canaryScope); strings.Contains(rr.Body.String(), canaryName) {
+		t.Errorf("expected the canary to be hidden from clients, got %v", rr.Body)
+	}
+
+	broken := http.NewServeMux()
+	broken.HandleFunc("/api/register", RegisterDevice)
+	broken.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, []Device{})
+	})
+	if err := canaryCheck(broken); err == nil {
+		t.Error("expected the canary check to fail when it isn't listed")
+	}
+
+	events := make(chan string, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Event string }
+		json.NewDecoder(r.Body).Decode(&body)
+		events <- body.Event
+	}))
+	defer srv.Close()
+	defer func(u string) { webhookURL = u }(webhookURL)
+	webhookURL = srv.URL
+
+	go runCanary(broken, time.Hour)
+	// Only the outcome of the check is notified, not the registration.
+	for {
+		select {
+		case e := <-events:
+			if !strings.HasPrefix(e, "canary_") {
+				continue
+			}
+			if e != "canary_failed" {
+				t.Errorf("expected canary_failed, got %q", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("expected the webhook to be notified")
+		}
+		return
+	}
+}
+
+func TestCanaryQuiet(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	var events sync.Map
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Event string }
+		json.NewDecoder(r.Body).Decode(&body)
+		events.Store(body.Event, true)
+	}))
+	defer srv.Close()
+	defer func(u string) { webhookURL = u }(webhookURL)
+	webhookURL = srv.URL
+
+	devices.RLock()
+	registrations, version := devices.registrations, devices.version
+	devices.RUnlock()
+	// Both the registration and the refresh of the canary.
+	for range 2 {
+		if err := canaryCheck(mux); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitWebhooks(t.Context())
+
+	devices.RLock()
+	defer devices.RUnlock()
+	if devices.registrations != registrations {
+		t.Errorf("expected the canary not to be counted, got %d registrations instead of %d", devices.registrations, registrations)
+	}
+	if devices.version != version {
+		t.Error("expected the canary not to change the devices to save")
+	}
+	events.Range(func(e, _ any) bool {
+		t.Errorf("expected no webhook for the canary, got %q", e)
+		return true
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// maxAPIVersion bounds the api_version a device can advertise.
+const maxAPIVersion = 1 << 16
+
+// Capabilities are the common features of a device, typed so that clients
+// don't have to parse them out of the free-form metadata.
+type Capabilities struct {
+	SupportsTLS       bool `json:"supports_tls"`
+	SupportsWebsocket bool `json:"supports_websocket"`
+	APIVersion        int  `json:"api_version,omitempty"`
+}
+
+// UnmarshalJSON rejects unknown capabilities, which would otherwise be
+// silently dropped.
+func (c *Capabilities) UnmarshalJSON(b []byte) error {
+	type capabilities Capabilities
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*capabilities)(c)); err != nil {
+		return fmt.Errorf(`"capabilities" is invalid: %v`, err)
+	}
+	return nil
+}
+
+func (c *Capabilities) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.APIVersion < 0 || c.APIVersion > maxAPIVersion {
+		return fmt.Errorf(`"api_version" must be between 0 and %d`, maxAPIVersion)
+	}
+	return nil
+}
+
+// equalCapabilities reports whether a and b advertise the same capabilities.
+func equalCapabilities(a, b *Capabilities) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
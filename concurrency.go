@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// concurrencyRetryAfter is the delay suggested to clients turned away by a
+// saturated endpoint, in seconds: requests are short, slots free up fast.
+const concurrencyRetryAfter = 1
+
+// maxConcurrency returns the limit of requests served at once on path, set
+// by the -max-concurrent-* flags, 0 when unbounded.
+func maxConcurrency(path string) int {
+	switch path {
+	case "/api/register", "/api/register/bulk", "/api/batch":
+		return registerConcurrency
+	case "/api/devices", "/api/devices/dnssd":
+		return listConcurrency
+	}
+	return 0
+}
+
+// limitConcurrency serves at most max requests at once with h, answering the
+// others 503 right away instead of queuing them.
+func limitConcurrency(h http.HandlerFunc, max int) http.HandlerFunc {
+	if max <= 0 {
+		return h
+	}
+
+	slots := make(chan struct{}, max)
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			h(w, r)
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfter))
+			http.Error(w, "Too many requests in progress, retry later", http.StatusServiceUnavailable)
+		}
+	}
+}
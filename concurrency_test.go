@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLimitConcurrency(t *testing.T) {
+	const max, clients = 3, 20
+
+	var inFlight, peak atomic.Int32
+	release := make(chan struct{})
+	started := make(chan struct{}, clients)
+	h := limitConcurrency(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-release
+	}, max)
+
+	codes := make(chan *httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			h(rr, httptest.NewRequest("GET", "/api/devices", nil))
+			codes <- rr
+		}()
+	}
+	for i := 0; i < max; i++ {
+		<-started
+	}
+
+	// Saturated: the other clients are turned away without waiting.
+	for i := max; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			h(rr, httptest.NewRequest("GET", "/api/devices", nil))
+			codes <- rr
+		}()
+	}
+	rejected := 0
+	for i := max; i < clients; i++ {
+		rr := <-codes
+		if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("expected 503 with Retry-After, got %d %q", rr.Code, rr.Header().Get("Retry-After"))
+		}
+		rejected++
+	}
+	close(release)
+	wg.Wait()
+	close(codes)
+	for rr := range codes {
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected the requests in progress to succeed, got %d", rr.Code)
+		}
+	}
+
+	if p := peak.Load(); p > max {
+		t.Errorf("expected at most %d requests at once, got %d", max, p)
+	}
+	if rejected != clients-max {
+		t.Errorf("expected %d rejections, got %d", clients-max, rejected)
+	}
+
+	// The slots are released once the requests are done.
+	rr := httptest.NewRecorder()
+	release = make(chan struct{})
+	close(release)
+	started = make(chan struct{}, 1)
+	h(rr, httptest.NewRequest("GET", "/api/devices", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200 once the load is gone, got %d", rr.Code)
+	}
+}
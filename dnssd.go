@@ -0,0 +1,89 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// dnssdService is a device as the DNS-SD records (RFC 6763) announcing it.
+type dnssdService struct {
+	PTR dnssdPTR `json:"ptr"`
+	SRV dnssdSRV `json:"srv"`
+	TXT []string `json:"txt"`
+}
+
+type dnssdPTR struct {
+	Name   string `json:"name"`   // service type, e.g. _http._tcp.local.
+	Target string `json:"target"` // service instance
+}
+
+type dnssdSRV struct {
+	Name     string `json:"name"`
+	Target   string `json:"target"`
+	Port     int    `json:"port"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+}
+
+// dnssdRecords returns the records of d. The service type is the scheme of
+// the device, "_device._tcp" when it has none, and the TXT entries carry its
+// location, path, tags and metadata.
+func dnssdRecords(d Device) dnssdService {
+	service := "_device._tcp.local."
+	if d.Scheme != "" {
+		service = "_" + d.Scheme + "._tcp.local."
+	}
+
+	name := d.Name
+	if name == "" {
+		name = d.ID()
+	}
+	instance := strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(name) + "." + service
+
+	txt := []string{"id=" + d.ID()}
+	if d.Location != "" {
+		txt = append(txt, "location="+d.Location)
+	}
+	if d.Path != "" {
+		txt = append(txt, "path="+d.Path)
+	}
+	if len(d.Tags) > 0 {
+		txt = append(txt, "tags="+strings.Join(d.Tags, ","))
+	}
+	for _, k := range slices.Sorted(maps.Keys(d.Metadata)) {
+		txt = append(txt, k+"="+d.Metadata[k])
+	}
+
+	return dnssdService{
+		PTR: dnssdPTR{service, instance},
+		SRV: dnssdSRV{Name: instance, Target: d.InternalAddress, Port: d.effectivePort()},
+		TXT: txt,
+	}
+}
+
+// ListDNSSD lists the devices of the caller as DNS-SD records, to feed them
+// into mDNS aware software.
+func ListDNSSD(w http.ResponseWriter, r *http.Request) {
+	if !enableDNSSD {
+		http.NotFound(w, r)
+		return
+	}
+
+	o, ok := queryOwner(w, r)
+	if !ok {
+		return
+	}
+
+	devices.RLock()
+	ds := devicesFor(o, queryFilter(r))
+	devices.RUnlock()
+
+	services := []dnssdService{}
+	for _, d := range ds {
+		services = append(services, dnssdRecords(d))
+	}
+
+	writeJSON(w, r, services)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestListDNSSD(t *testing.T) {
+	defer func(v bool) { enableDNSSD = v }(enableDNSSD)
+
+	post(t, RegisterDevice, "80.2.3.65:321", `{"name":"Living.room","address":"192.168.100.30","scheme":"https","location":"Floor 1","tags":["tv"]}`)
+
+	rr := get(t, ListDNSSD, "80.2.3.65:321", "/api/devices/dnssd")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected DNS-SD to be disabled, got %v", rr.Code)
+	}
+
+	enableDNSSD = true
+	rr = get(t, ListDNSSD, "80.2.3.65:321", "/api/devices/dnssd")
+	var services []dnssdService
+	if err := json.Unmarshal(rr.Body.Bytes(), &services); err != nil || len(services) != 1 {
+		t.Fatalf("unexpected services %v: %v", rr.Body.String(), err)
+	}
+
+	s := services[0]
+	instance := `Living\.room._https._tcp.local.`
+	if s.PTR != (dnssdPTR{"_https._tcp.local.", instance}) {
+		t.Errorf("unexpected PTR record %+v", s.PTR)
+	}
+	if s.SRV != (dnssdSRV{Name: instance, Target: "192.168.100.30", Port: 443}) {
+		t.Errorf("unexpected SRV record %+v", s.SRV)
+	}
+	if len(s.TXT) != 3 || !reflect.DeepEqual(s.TXT[1:], []string{"location=Floor 1", "tags=tv"}) {
+		t.Errorf("unexpected TXT record %v", s.TXT)
+	}
+}
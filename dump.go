@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// saveMu serializes the saves, so snapshots and the shutdown save don't
+// write the dump at the same time.
+var (
+	saveMu       sync.Mutex
+	saved        bool
+	savedVersion uint64 // devices.version when last saved
+)
+
+// loading is set while the initial load of the dump runs: saving then would
+// overwrite the dump with the devices not loaded yet.
+var loading atomic.Bool
+
+var errLoading = errors.New("the dump is still loading")
+
+// gzipMagic starts every gzip stream, it tells compressed dumps apart.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func saveDevices(dumpPath string) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	if loading.Load() {
+		return errLoading
+	}
+
+	// The dump is replaced at once, a crash while writing leaves the previous
+	// one in place.
+	tmp := dumpPath + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	defer os.Remove(tmp) // no-op once renamed
+
+	var w io.Writer = fd
+	if dumpCompress {
+		zw := gzip.NewWriter(fd)
+		defer zw.Close()
+		w = zw
+	}
+
+	// The registrations counter follows the devices in the stream, where
+	// older versions stop reading.
+	devices.RLock()
+	version := devices.version
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(devices.d)
+	if err == nil {
+		err = enc.Encode(devices.registrations)
+	}
+	devices.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if zw, ok := w.(*gzip.Writer); ok {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dumpPath); err != nil {
+		return err
+	}
+
+	saved, savedVersion = true, version
+	return nil
+}
+
+// dumpUpToDate reports whether the devices didn't change since last saved.
+func dumpUpToDate() bool {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	devices.RLock()
+	defer devices.RUnlock()
+
+	return saved && savedVersion == devices.version
+}
+
+// snapshot periodically saves the devices when they changed.
+func snapshot(interval time.Duration) {
+	for range time.Tick(interval) {
+		if dumpUpToDate() {
+			continue
+		}
+		if err := saveDevices(dumpPath); err != nil {
+			log.Println("Unable to save snapshot:", err)
+		}
+	}
+}
+
+// errBadDump is returned by loadDevices when the dump exists but can't be
+// decoded, e.g. because it was written by an incompatible version.
+var errBadDump = errors.New("unable to decode dump")
+
+func loadDevices(dumpPath string) (d []Device, registrations uint64, err error) {
+	var fd *os.File
+	fd, err = os.Open(dumpPath)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	// Dumps are compressed or not depending on -dump-compress when saved.
+	var r io.Reader = bufio.NewReader(fd)
+	if magic, _ := r.(*bufio.Reader).Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(r); err != nil {
+			err = fmt.Errorf("%w: %v", errBadDump, err)
+			return
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	dec := gob.NewDecoder(r)
+	if err = dec.Decode(&d); err != nil {
+		err = fmt.Errorf("%w: %v", errBadDump, err)
+		return
+	}
+	// Dumps from before the registrations counter end with the devices.
+	if err = dec.Decode(&registrations); err == io.EOF {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("%w: %v", errBadDump, err)
+		return
+	}
+
+	// Dumps from before LastSeen existed refreshed Added instead, and those
+	// from before schema versions only held version 1 devices.
+	for i := range d {
+		if d[i].LastSeen.IsZero() {
+			d[i].LastSeen = d[i].Added
+		}
+		if d[i].SchemaVersion == 0 {
+			d[i].SchemaVersion = 1
+		}
+		d[i].utc()
+	}
+
+	// The devices which expired while the service was down must not come
+	// back until the first cleanup.
+	var dropped int
+	d, dropped = dropExpired(d)
+	if dropped > 0 {
+		log.Println("Dropped", dropped, "devices expired since the dump was saved")
+	}
+
+	return
+}
+
+// dropExpired removes the expired devices and tombstones from d, returning
+// how many were removed.
+func dropExpired(d []Device) ([]Device, int) {
+	n := len(d)
+	d = slices.DeleteFunc(d, func(d Device) bool {
+		return d.expired()
+	})
+	return d, n - len(d)
+}
+
+// restoreDevices loads the dump, applying the given policy ("fail", "ignore"
+// or "backup") when it can't be decoded.
+func restoreDevices(dumpPath string, policy string) ([]Device, uint64, error) {
+	loading.Store(true)
+	defer loading.Store(false)
+
+	d, registrations, err := loadDevices(dumpPath)
+	if !errors.Is(err, errBadDump) || policy == "fail" {
+		return d, registrations, err
+	}
+
+	log.Println("Ignoring saved states:", err)
+	if policy == "backup" {
+		if err := os.Rename(dumpPath, dumpPath+".bad"); err != nil {
+			return nil, 0, err
+		}
+		log.Println("Unreadable dump moved to", dumpPath+".bad")
+	}
+
+	return make([]Device, 0), 0, nil
+}
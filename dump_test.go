@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestoreBadDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump")
+
+	for _, policy := range []string{"fail", "ignore", "backup"} {
+		if err := os.WriteFile(path, []byte("not a gob stream"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		d, _, err := restoreDevices(path, policy)
+		if policy == "fail" {
+			if !errors.Is(err, errBadDump) {
+				t.Errorf("%s: expected errBadDump, got %v", policy, err)
+			}
+			continue
+		}
+
+		if err != nil || d == nil || len(d) != 0 {
+			t.Errorf("%s: expected an empty store, got %v - %v", policy, d, err)
+		}
+		if _, err := os.Stat(path + ".bad"); policy == "backup" && err != nil {
+			t.Errorf("%s: expected a backup of the dump: %v", policy, err)
+		}
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	defer func(b bool) { dumpCompress = b }(dumpCompress)
+
+	now := time.Now().UTC().Round(0)
+	devices.Lock()
+	saved := devices.d
+	setDevices([]Device{{
+		ExternalAddress: "80.2.3.41",
+		InternalAddress: "192.168.100.151",
+		Port:            8080,
+		Ports:           []int{8080},
+		Name:            "Testdevice",
+		Added:           now,
+		LastSeen:        now,
+		Tags:            []string{"role=primary"},
+		Path:            "/description.xml",
+		Capabilities:    &Capabilities{SupportsTLS: true, APIVersion: 2},
+		SchemaVersion:   1,
+	}})
+	expected := devices.d
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		setDevices(saved)
+		devices.Unlock()
+	}()
+
+	for _, compress := range []bool{false, true} {
+		dumpCompress = compress
+		path := filepath.Join(t.TempDir(), "dump")
+
+		if err := saveDevices(path); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isGzip := len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b; isGzip != compress {
+			t.Errorf("compress=%v: dump compressed: %v", compress, isGzip)
+		}
+
+		d, _, err := loadDevices(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(d, expected) {
+			t.Errorf("compress=%v: got %v want %v", compress, d, expected)
+		}
+	}
+}
+
+func TestConcurrentSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := saveDevices(path); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	d, _, err := loadDevices(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices.RLock()
+	defer devices.RUnlock()
+	if len(d) != len(devices.d) {
+		t.Errorf("loaded %d devices, expected %d", len(d), len(devices.d))
+	}
+}
+
+func TestSaveReplacesDump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump")
+	if err := saveDevices(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the temporary file to be renamed, got %v", err)
+	}
+
+	// A failed save leaves the previous dump in place.
+	if err := os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveDevices(path); err == nil {
+		t.Error("expected the save to fail")
+	}
+	if _, _, err := loadDevices(path); err != nil {
+		t.Errorf("expected the previous dump to load, got %v", err)
+	}
+}
+
+func TestDumpUpToDate(t *testing.T) {
+	forget("80.2.3.54")
+	path := filepath.Join(t.TempDir(), "dump")
+	if err := saveDevices(path); err != nil {
+		t.Fatal(err)
+	}
+	if !dumpUpToDate() {
+		t.Error("dump not up to date right after a save")
+	}
+
+	post(t, RegisterDevice, "80.2.3.54:321", `{"name":"Testdevice","address":"192.168.100.244"}`)
+	if dumpUpToDate() {
+		t.Error("dump up to date after a registration")
+	}
+}
+
+func TestLoadDropsExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump")
+
+	old := time.Now().Add(-2 * lifetime)
+	devices.Lock()
+	saved := devices.d
+	setDevices([]Device{
+		{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.60", Added: old, LastSeen: old},
+		{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.61", Added: time.Now(), LastSeen: time.Now()},
+	})
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		setDevices(saved)
+		devices.Unlock()
+	}()
+
+	if err := saveDevices(path); err != nil {
+		t.Fatal(err)
+	}
+	d, _, err := loadDevices(path)
+	if err != nil || len(d) != 1 || d[0].InternalAddress != "192.168.100.61" {
+		t.Errorf("expected only the device still alive, got %v - %v", d, err)
+	}
+}
+
+func TestLoadDumpWithoutRegistrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump")
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = gob.NewEncoder(fd).Encode([]Device{{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.63", Added: now, LastSeen: now}})
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, registrations, err := loadDevices(path)
+	if err != nil || len(d) != 1 || registrations != 0 {
+		t.Errorf("expected the device without registrations, got %v, %v - %v", d, registrations, err)
+	}
+}
+
+func TestNoSaveWhileLoading(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump")
+	if err := os.WriteFile(path, []byte("saved devices"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A signal received during a slow load finds it still running.
+	loading.Store(true)
+	err := saveDevices(path)
+	loading.Store(false)
+
+	if !errors.Is(err, errLoading) {
+		t.Errorf("expected errLoading, got %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "saved devices" {
+		t.Errorf("expected the dump to be untouched, got %q", b)
+	}
+}
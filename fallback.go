@@ -0,0 +1,37 @@
+package main
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+	"os"
+)
+
+// fallbackIndex is the landing page served when the static files are missing.
+//
+//go:embed fallback/index.html
+var fallbackIndex []byte
+
+// staticHandler serves the files of dir, or the built-in landing page at /
+// when dir doesn't exist, so that the root isn't an error page. With
+// -no-static, nothing is served.
+func staticHandler(dir string) http.Handler {
+	if noStatic {
+		return http.NotFoundHandler()
+	}
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return http.FileServer(http.Dir(dir))
+	}
+
+	log.Println("No", dir, "directory, serving the built-in landing page")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write(fallbackIndex); err != nil {
+			writeFailed(r, err)
+		}
+	})
+}
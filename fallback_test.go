@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStaticFallback(t *testing.T) {
+	h := staticHandler(filepath.Join(t.TempDir(), "missing"))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/api/devices") {
+		t.Errorf("expected the built-in landing page, got %d - %v", rr.Code, rr.Body)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/style.css", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for the other files, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	staticHandler("public").ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "This service lets devices") {
+		t.Errorf("expected the public index, got %d", rr.Code)
+	}
+
+	defer func(b bool) { noStatic = b }(noStatic)
+	noStatic = true
+	rr = httptest.NewRecorder()
+	staticHandler(filepath.Join(t.TempDir(), "missing")).ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 with -no-static, got %d", rr.Code)
+	}
+}
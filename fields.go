@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// deviceFields are the names of the fields of a device in the JSON output,
+// the ones computed by Device.MarshalJSON included.
+var deviceFields = func() map[string]bool {
+	fields := map[string]bool{"id": true, "state": true, "stale": true, "deleted": true, "effective_port": true, "lifetime": true}
+	t := reflect.TypeFor[Device]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// projection lists the fields of each device to output, all of them when nil.
+type projection []string
+
+// queryFields returns the fields selected by the comma separated "fields"
+// query parameter. "fields=address" is the plain list of addresses instead,
+// and selects no projection. It replies with an error and returns false for
+// an unknown field.
+func queryFields(w http.ResponseWriter, r *http.Request) (projection, bool) {
+	v := r.URL.Query().Get("fields")
+	if v == "" || v == "address" {
+		return nil, true
+	}
+
+	var p projection
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if !deviceFields[f] {
+			http.Error(w, `"fields" has an unknown field: `+f, http.StatusBadRequest)
+			return nil, false
+		}
+		p = append(p, f)
+	}
+	return p, true
+}
+
+// apply returns d with only the fields of the projection.
+func (p projection) apply(d Device) (interface{}, error) {
+	if p == nil {
+		return d, nil
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	projected := make(map[string]json.RawMessage, len(p))
+	for _, f := range p {
+		// Empty optional fields are left out, as in the full output.
+		if v, ok := all[f]; ok {
+			projected[f] = v
+		}
+	}
+	return projected, nil
+}
+
+// applyAll returns ds with only the fields of the projection.
+func (p projection) applyAll(ds []Device) (interface{}, error) {
+	if p == nil {
+		return ds, nil
+	}
+
+	projected := make([]interface{}, 0, len(ds))
+	for _, d := range ds {
+		v, err := p.apply(d)
+		if err != nil {
+			return nil, err
+		}
+		projected = append(projected, v)
+	}
+	return projected, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set by the admin before a shutdown: the service stops being
+// ready, so that the load balancer moves the traffic away, but keeps serving
+// until it gets SIGTERM.
+var draining atomic.Bool
+
+// Healthz tells whether the process is alive.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := fmt.Fprintln(w, "ok"); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+// Readyz tells whether the service should receive traffic, and is able to
+// save the devices when it has a dump.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if err := dumpWritable(); err != nil {
+		http.Error(w, "unable to write the dump: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := fmt.Fprintln(w, "ok"); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+// dumpCheckInterval is how long the result of the dump write test is reused,
+// probes come much more often.
+const dumpCheckInterval = 30 * time.Second
+
+var dumpCheck struct {
+	sync.Mutex
+	checked time.Time
+	path    string
+	err     error
+}
+
+// dumpWritable tests writing a file next to the dump, so that a read-only
+// file system is noticed before the shutdown fails to save the devices.
+func dumpWritable() error {
+	if dumpPath == "" {
+		return nil
+	}
+
+	dumpCheck.Lock()
+	defer dumpCheck.Unlock()
+	if dumpCheck.path == dumpPath && time.Since(dumpCheck.checked) < dumpCheckInterval {
+		return dumpCheck.err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dumpPath), ".nupnp-check-*")
+	if err == nil {
+		_, err = f.Write([]byte("ok"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(f.Name())
+	}
+	if err != nil && dumpCheck.err == nil {
+		log.Println("The dump can't be written:", err)
+	}
+	dumpCheck.checked, dumpCheck.path, dumpCheck.err = time.Now(), dumpPath, err
+	return err
+}
+
+// AdminDrain flips the service into draining mode. There is no way back but
+// a restart.
+func AdminDrain(w http.ResponseWriter, r *http.Request) {
+	if !draining.Swap(true) {
+		log.Println("Draining, /readyz now answers 503")
+	}
+	writeJSON(w, r, struct {
+		Draining bool `json:"draining"`
+	}{true})
+}
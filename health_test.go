@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	defer draining.Store(false)
+
+	for _, h := range []http.HandlerFunc{Healthz, Readyz} {
+		if rr := get(t, h, "80.2.3.88:321", "/"); rr.Code != http.StatusOK {
+			t.Errorf("expected 200 before draining, got %d", rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	AdminDrain(rr, httptest.NewRequest("POST", "/api/admin/drain", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("drain returned %d - %v", rr.Code, rr.Body)
+	}
+
+	if rr := get(t, Readyz, "80.2.3.88:321", "/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to answer 503 while draining, got %d", rr.Code)
+	}
+	if rr := get(t, Healthz, "80.2.3.88:321", "/healthz"); rr.Code != http.StatusOK {
+		t.Errorf("expected /healthz to stay 200 while draining, got %d", rr.Code)
+	}
+	if rr := get(t, ListDevices, "80.2.3.88:321", "/api/devices"); rr.Code != http.StatusOK {
+		t.Errorf("expected the API to keep serving while draining, got %d", rr.Code)
+	}
+}
+
+func TestReadyzDumpWritable(t *testing.T) {
+	defer func(path string) { dumpPath = path }(dumpPath)
+	dir := t.TempDir()
+	dumpPath = filepath.Join(dir, "dump")
+
+	if rr := get(t, Readyz, "80.2.3.88:321", "/readyz"); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 with a writable dump, got %d - %v", rr.Code, rr.Body)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the test file to be removed, got %v", entries)
+	}
+
+	dumpPath = filepath.Join(dir, "missing", "dump")
+	if rr := get(t, Readyz, "80.2.3.88:321", "/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when the dump can't be written, got %d", rr.Code)
+	}
+
+	// The result is reused until the next check.
+	os.Mkdir(filepath.Join(dir, "missing"), 0755)
+	if rr := get(t, Readyz, "80.2.3.88:321", "/readyz"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the failed check to be cached, got %d", rr.Code)
+	}
+	dumpCheck.Lock()
+	dumpCheck.checked = time.Now().Add(-dumpCheckInterval)
+	dumpCheck.Unlock()
+	if rr := get(t, Readyz, "80.2.3.88:321", "/readyz"); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 once the dump can be written again, got %d", rr.Code)
+	}
+}
+
+func TestHealthWriteFailed(t *testing.T) {
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	for _, h := range []http.HandlerFunc{Healthz, Readyz} {
+		out.Reset()
+		h(brokenWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/healthz", nil))
+		if !strings.Contains(out.String(), "unable to write the response") {
+			t.Errorf("expected the failed write to be logged, got %q", out.String())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// expiryHook is run when a device it was selected for expires. It must
+// return once ctx is done.
+type expiryHook func(ctx context.Context, d Device) error
+
+// expiryHookRegistry holds the hooks -expiry-hooks can select, by name.
+// Other hooks only need to be added here.
+var expiryHookRegistry = map[string]expiryHook{
+	"log":     logExpiryHook,
+	"webhook": webhookExpiryHook,
+}
+
+// expiryRule runs a hook for the expiring devices carrying a tag, or for all
+// of them with "*".
+type expiryRule struct {
+	hook, tag string
+}
+
+// expiryRules are the rules parsed from -expiry-hooks.
+var expiryRules []expiryRule
+
+// Hooks are bounded: each one is given expiryHookTimeout, and at most
+// maxRunningHooks run at once, the others are skipped.
+const (
+	expiryHookTimeout = 5 * time.Second
+	maxRunningHooks   = 16
+)
+
+var runningHooks = make(chan struct{}, maxRunningHooks)
+
+// parseExpiryHooks parses comma separated <hook>:<tag> rules.
+func parseExpiryHooks(s string) ([]expiryRule, error) {
+	var rules []expiryRule
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		hook, tag, ok := strings.Cut(r, ":")
+		if !ok || tag == "" {
+			return nil, fmt.Errorf("%q is not a <hook>:<tag> rule", r)
+		}
+		if _, ok := expiryHookRegistry[hook]; !ok {
+			return nil, fmt.Errorf("unknown expiry hook %q", hook)
+		}
+		if hook == "webhook" && expiryWebhookURL == "" {
+			return nil, errors.New("the webhook expiry hook needs -expiry-webhook")
+		}
+		rules = append(rules, expiryRule{hook, tag})
+	}
+	return rules, nil
+}
+
+// runExpiryHooks starts the hooks selected for the expiring device. They run
+// in the background, it is safe to call with the lock held.
+func runExpiryHooks(d Device) {
+	for _, rule := range expiryRules {
+		if rule.tag != "*" && !d.hasTags([]string{rule.tag}) {
+			continue
+		}
+
+		select {
+		case runningHooks <- struct{}{}:
+		default:
+			log.Println("expiry hook", rule.hook, "skipped for", logIP(d.InternalAddress)+": too many hooks running")
+			continue
+		}
+		go func(name string, h expiryHook) {
+			defer func() { <-runningHooks }()
+			ctx, cancel := context.WithTimeout(context.Background(), expiryHookTimeout)
+			defer cancel()
+			if err := h(ctx, d); err != nil {
+				log.Println("expiry hook", name+":", err)
+			}
+		}(rule.hook, expiryHookRegistry[rule.hook])
+	}
+}
+
+func logExpiryHook(ctx context.Context, d Device) error {
+	log.Println("expired", logIP(d.InternalAddress), "of", logIP(d.ExternalAddress), "last seen", d.LastSeen.Format(time.RFC3339))
+	return nil
+}
+
+// webhookExpiryHook posts the expired device to the -expiry-webhook, in the
+// format of the -webhook notifications.
+func webhookExpiryHook(ctx context.Context, d Device) error {
+	body, err := json.Marshal(struct {
+		Event           string `json:"event"`
+		ExternalAddress string `json:"externaladdress"`
+		Device          Device `json:"device"`
+	}{"expired", d.ExternalAddress, d})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", expiryWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("notification returned " + resp.Status)
+	}
+	return nil
+}
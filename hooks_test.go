@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseExpiryHooks(t *testing.T) {
+	defer func(u string) { expiryWebhookURL = u }(expiryWebhookURL)
+	expiryWebhookURL = ""
+
+	if rules, err := parseExpiryHooks("log:*, log:role=camera"); err != nil || len(rules) != 2 || rules[1] != (expiryRule{"log", "role=camera"}) {
+		t.Errorf("got %v - %v", rules, err)
+	}
+	for _, s := range []string{"log", "log:", "exec:*", "webhook:*"} {
+		if _, err := parseExpiryHooks(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestExpiryHooks(t *testing.T) {
+	expired := make(chan Device, 2)
+	expiryHookRegistry["test"] = func(ctx context.Context, d Device) error {
+		expired <- d
+		return nil
+	}
+	defer delete(expiryHookRegistry, "test")
+
+	received := make(chan Device, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event struct{ Device Device }
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event.Device
+	}))
+	defer srv.Close()
+
+	defer func(rules []expiryRule, u string) { expiryRules, expiryWebhookURL = rules, u }(expiryRules, expiryWebhookURL)
+	expiryWebhookURL = srv.URL
+	var err error
+	if expiryRules, err = parseExpiryHooks("test:camera,webhook:camera"); err != nil {
+		t.Fatal(err)
+	}
+
+	runExpiryHooks(Device{InternalAddress: "192.168.100.97", Tags: []string{"printer"}})
+	runExpiryHooks(Device{InternalAddress: "192.168.100.98", Tags: []string{"camera"}})
+
+	for _, ch := range []chan Device{expired, received} {
+		select {
+		case d := <-ch:
+			if d.InternalAddress != "192.168.100.98" {
+				t.Errorf("expected the hooks of the camera only, got %s", d.InternalAddress)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the hooks to run")
+		}
+	}
+	select {
+	case d := <-expired:
+		t.Errorf("expected no hook for %s", d.InternalAddress)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
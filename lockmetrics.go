@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockBuckets are the upper bounds, in seconds, of the lock histograms.
+var lockBuckets = []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1, 10}
+
+// histogram counts durations in lockBuckets, without locking so that
+// observing doesn't contend with the lock being measured.
+type histogram struct {
+	counts [8]atomic.Uint64 // per bucket, the last one is +Inf
+	sum    atomic.Int64     // nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(lockBuckets) && d.Seconds() > lockBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// write writes the series of h in the Prometheus text format, with the
+// given labels, e.g. `mode="read"`.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var count uint64
+	for i := range h.counts {
+		count += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(lockBuckets) {
+			le = strconv.FormatFloat(lockBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, le, count)
+	}
+	fmt.Fprintf(w, "%s_sum{%s} %v\n", name, labels, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, count)
+}
+
+// timedRWMutex is a sync.RWMutex recording how long it is waited for and
+// held, to tell whether slow readers starve the writers. Readers share the
+// lock, so their hold time is that of each period during which the lock is
+// read locked, which is how long writers are kept out.
+type timedRWMutex struct {
+	mu        sync.RWMutex
+	locked    time.Time    // when the write lock was acquired
+	readers   atomic.Int64 // holding the read lock
+	readSince atomic.Int64 // unix nanoseconds, when the first of them acquired it
+
+	readWait, writeWait, readHold, writeHold histogram
+}
+
+func (m *timedRWMutex) Lock() {
+	start := time.Now()
+	m.mu.Lock()
+	m.locked = time.Now()
+	m.writeWait.observe(m.locked.Sub(start))
+}
+
+func (m *timedRWMutex) Unlock() {
+	held := time.Since(m.locked)
+	m.mu.Unlock()
+	m.writeHold.observe(held)
+}
+
+func (m *timedRWMutex) RLock() {
+	start := time.Now()
+	m.mu.RLock()
+	now := time.Now()
+	m.readWait.observe(now.Sub(start))
+	if m.readers.Add(1) == 1 {
+		m.readSince.Store(now.UnixNano())
+	}
+}
+
+func (m *timedRWMutex) RUnlock() {
+	// Loaded first, the next reader can only replace it once this one left.
+	since := m.readSince.Load()
+	if m.readers.Add(-1) == 0 {
+		m.readHold.observe(time.Duration(time.Now().UnixNano() - since))
+	}
+	m.mu.RUnlock()
+}
+
+// writeMetrics writes the histograms of m.
+func (m *timedRWMutex) writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP nupnp_devices_lock_wait_seconds Time waited to acquire the devices lock.\n# TYPE nupnp_devices_lock_wait_seconds histogram\n")
+	m.readWait.write(w, "nupnp_devices_lock_wait_seconds", `mode="read"`)
+	m.writeWait.write(w, "nupnp_devices_lock_wait_seconds", `mode="write"`)
+	fmt.Fprintf(w, "# HELP nupnp_devices_lock_hold_seconds Time the devices lock was held, each period of read locking for readers.\n# TYPE nupnp_devices_lock_hold_seconds histogram\n")
+	m.readHold.write(w, "nupnp_devices_lock_hold_seconds", `mode="read"`)
+	m.writeHold.write(w, "nupnp_devices_lock_hold_seconds", `mode="write"`)
+}
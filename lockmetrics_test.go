@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimedRWMutex(t *testing.T) {
+	var m timedRWMutex
+	m.Lock()
+	time.Sleep(2 * time.Millisecond)
+	m.Unlock()
+
+	// Overlapping readers make a single read locked period.
+	var wg sync.WaitGroup
+	m.RLock()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.RLock()
+			defer m.RUnlock()
+		}()
+	}
+	wg.Wait()
+	m.RUnlock()
+
+	var body bytes.Buffer
+	m.writeMetrics(&body)
+	for _, want := range []string{
+		`nupnp_devices_lock_hold_seconds_bucket{mode="write",le="0.001"} 0`,
+		`nupnp_devices_lock_hold_seconds_count{mode="write"} 1`,
+		`nupnp_devices_lock_hold_seconds_count{mode="read"} 1`,
+		`nupnp_devices_lock_wait_seconds_count{mode="read"} 5`,
+		`nupnp_devices_lock_wait_seconds_bucket{mode="write",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body.String(), want+"\n") {
+			t.Errorf("expected %q in the metrics, got %v", want, body.String())
+		}
+	}
+}
+
+func TestLockMetrics(t *testing.T) {
+	rr := get(t, Metrics, "80.2.3.105:321", "/metrics")
+	if !strings.Contains(rr.Body.String(), "# TYPE nupnp_devices_lock_wait_seconds histogram\n") {
+		t.Errorf("expected the lock histograms in the metrics, got %v", rr.Body.String())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// logSampler limits how many add/update lines are logged per second.
+var logSampler struct {
+	sync.Mutex
+	second     time.Time
+	count      int
+	suppressed int
+}
+
+// logSampled logs like log.Println, unless logSampleRate lines were already
+// logged during the current second.
+func logSampled(v ...interface{}) {
+	if logSampleRate <= 0 {
+		log.Println(v...)
+		return
+	}
+
+	logSampler.Lock()
+	defer logSampler.Unlock()
+
+	now := time.Now().Truncate(time.Second)
+	if !now.Equal(logSampler.second) {
+		logSampler.second = now
+		logSampler.count = 0
+	}
+	if logSampler.count >= logSampleRate {
+		logSampler.suppressed++
+		return
+	}
+	logSampler.count++
+	log.Println(v...)
+}
+
+// logSampleSummary periodically logs how many lines were suppressed.
+func logSampleSummary(interval time.Duration) {
+	for range time.Tick(interval) {
+		logSampler.Lock()
+		n := logSampler.suppressed
+		logSampler.suppressed = 0
+		logSampler.Unlock()
+
+		if n > 0 {
+			log.Println("suppressed", n, "add/update log lines")
+		}
+	}
+}
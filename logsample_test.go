@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestLogSampled(t *testing.T) {
+	defer func(r int) { logSampleRate = r }(logSampleRate)
+	logSampleRate = 2
+
+	logSampler.Lock()
+	logSampler.count, logSampler.suppressed = 0, 0
+	logSampler.Unlock()
+
+	for i := 0; i < 5; i++ {
+		logSampled("added", i)
+	}
+
+	logSampler.Lock()
+	defer logSampler.Unlock()
+	// The loop may straddle a second boundary, letting more lines through.
+	if logSampler.suppressed == 0 || logSampler.suppressed > 3 {
+		t.Errorf("suppressed %d lines, expected 3", logSampler.suppressed)
+	}
+}
@@ -1,279 +1,2284 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/gob"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 )
 
 var (
 	lifetime = 24 * time.Hour
 	httpAddr = ":8180"
 	dumpPath = ""
+
+	onDumpError = "fail"
+
+	cleanupMinInterval  time.Duration
+	tombstoneWindow     time.Duration
+	reusePort           bool
+	adminToken          = ""
+	webhookURL          = ""
+	requireScopeToken   bool
+	logSampleRate       int
+	publicURL           = ""
+	registerLimit       int
+	registerWindow      = time.Minute
+	maxLifetime         time.Duration
+	handlerTimeout      time.Duration
+	anonymizeIPs        bool
+	noRefreshOnMetadata bool
+	tenants             = ""
+	ipv6ScopePrefix     int
+	staleWindow         time.Duration
+	dumpCompress        bool
+	snapshotInterval    time.Duration
+	prettyJSON          bool
+	offlineGrace        time.Duration
+	proxyProtocol       bool
+	adminStaticDir      = "admin"
+	requirePrivate      bool
+	expireArchive       string
+	maxBodyBytes        = int64(1 << 20)
+	maxBulk             = 100
+	allowGetRegister    bool
+	faviconPath         = "public/favicon.ico"
+	faviconMaxAge       = 24 * time.Hour
+	enableDNSSD         bool
+	expiryJitter        time.Duration
+	maxExternalIPs      int
+	maxMetadataBytes    = 4096
+	h2c                 bool
+	maxSchemaVersion    = 1
+	listCacheSeconds    int
+	accessLogEnabled    bool
+	logLevel            = "info"
+	portGrace           time.Duration
+	selfCheckEnabled    bool
+	registerConcurrency int
+	listConcurrency     int
+	maxPortsPerHost     int
+	portsWindow         = time.Hour
+	portsAction         = "warn"
+	allowReset          bool
+	signKey             string
+	allowedHosts        string
+	listenBacklog       int
+	noStatic            bool
+	cleanupBatch        = 1000
+	expiryHooks         string
+	expiryWebhookURL    string
+	requireHTTPS        bool
+	anonymizeStrategy   = "mask"
+	minTTL              time.Duration
+	maxTTL              time.Duration
+	ttlPolicy           = "clamp"
+	canaryEnabled       bool
+	canaryInterval      = time.Minute
+	massExpiryThreshold float64
+	massExpiryAction    = "warn"
+	shutdownTimeout     = 10 * time.Second
+
+	maxTags      = 16
+	maxTagLength = 64
+
+	maxScopeLength = 128
+
+	maxNameLength     = 128
+	maxLocationLength = 128
+	maxSchemeLength   = 32
+	maxPathLength     = 256
+
+	maxPriority = 1000
+
+	maxAddresses = 8
 )
 
 var devices struct {
-	sync.RWMutex
-	d []Device
+	timedRWMutex
+	d             []Device
+	version       uint64    // incremented on each change, to know when to save
+	modified      time.Time // time of the last change
+	registrations uint64    // handled since the first start, saved in the dump
+
+	// Indexes in d of the devices of each external address, valid as long as
+	// no device was added or removed since, see byExternalAddress.
+	byEA       map[string][]int
+	generation uint64 // incremented each time devices are added or removed
+	indexedGen uint64 // generation of byEA
+}
+
+// changed records a change of the devices. The devices lock must be held.
+func changed() {
+	devices.version++
+	devices.modified = time.Now()
 }
 
 type Device struct {
-	ExternalAddress string    `json:"-"`
-	InternalAddress string    `json:"internaladdress"`
-	Port            int       `json:"port,omitempty"` // optional
-	Name            string    `json:"name"`
-	Added           time.Time `json:"added"`
+	ExternalAddress string            `json:"-"`
+	InternalAddress string            `json:"internaladdress"`
+	Port            int               `json:"port,omitempty"` // optional
+	Name            string            `json:"name"`
+	Added           time.Time         `json:"added"`                    // first registration
+	LastSeen        time.Time         `json:"last_seen"`                // refreshed by each registration
+	Tags            []string          `json:"tags,omitempty"`           // optional
+	Ports           []int             `json:"ports,omitempty"`          // optional, Port is the first one
+	Location        string            `json:"location,omitempty"`       // optional
+	Scheme          string            `json:"scheme,omitempty"`         // optional, e.g. https
+	Path            string            `json:"path,omitempty"`           // optional, e.g. /description.xml
+	Metadata        map[string]string `json:"metadata,omitempty"`       // optional
+	Capabilities    *Capabilities     `json:"capabilities,omitempty"`   // optional
+	Addresses       []string          `json:"addresses,omitempty"`      // optional, all the internal addresses, InternalAddress first
+	SchemaVersion   int               `json:"schema_version"`           // format of the payload, chosen by the client
+	Priority        int               `json:"priority"`                 // optional, for clients picking the highest
+	ExpiresAt       time.Time         `json:"expires_at,omitzero"`      // optional, replaces the lifetime
+	PreviousPorts   []previousPort    `json:"previous_ports,omitempty"` // ports dropped less than -port-grace ago
+	Pinned          bool              `json:"pinned,omitempty"`         // never removed by cleanup, set by the admin
+	Deleted         time.Time         `json:"-"`                        // set on tombstones
+	TokenHash       string            `json:"-"`                        // hash of the token returned on registration
+	Scope           string            `json:"-"`                        // optional token chosen by the client
+	Extended        time.Duration     `json:"-"`                        // added to the lifetime until the next registration
+	Tenant          string            `json:"-"`                        // set when registered under /t/{tenant}/
+
+	listedAt time.Time // time of the request listing it with include_lifetime
+}
+
+// owner identifies who can see a device: the network it was registered from,
+// the scope token its client optionally chose and the tenant it belongs to.
+type owner struct {
+	ea, scope, tenant string
+}
+
+func (d Device) ownedBy(o owner) bool {
+	return d.ExternalAddress == o.ea && d.Scope == o.scope && d.Tenant == o.tenant
+}
+
+// MarshalJSON adds the computed fields to the JSON representation of the
+// device.
+func (d Device) MarshalJSON() ([]byte, error) {
+	type device Device
+	d.utc()
+	d.PreviousPorts = d.recentPorts()
+	return json.Marshal(struct {
+		device
+		ID        string    `json:"id"`
+		State     string    `json:"state"`
+		Stale     bool      `json:"stale"`
+		IsDeleted bool      `json:"deleted,omitempty"`
+		Effective int       `json:"effective_port,omitempty"`
+		Lifetime  *timeline `json:"lifetime,omitempty"`
+	}{device(d), d.ID(), d.state(), d.stale(), !d.Deleted.IsZero(), d.effectivePort(), d.timeline()})
+}
+
+// timeline is the lifetime of a listed device, for the presence timelines of
+// monitoring UIs.
+type timeline struct {
+	Added     time.Time `json:"added"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+	TTL       int64     `json:"ttl_seconds"`       // from last_seen to expires
+	Remaining int64     `json:"remaining_seconds"` // from the request to expires
+}
+
+// timeline returns the timeline of the device when it is listed with
+// include_lifetime, nil otherwise.
+func (d Device) timeline() *timeline {
+	if d.listedAt.IsZero() {
+		return nil
+	}
+	expires := d.expiresAt().UTC()
+	return &timeline{
+		Added:     d.Added,
+		LastSeen:  d.LastSeen,
+		Expires:   expires,
+		TTL:       int64(expires.Sub(d.LastSeen) / time.Second),
+		Remaining: int64(max(expires.Sub(d.listedAt), 0) / time.Second),
+	}
+}
+
+// utc normalizes the times of the device to UTC, so that they are output the
+// same way whatever the time zone of the server or of the clients.
+func (d *Device) utc() {
+	d.Added = d.Added.UTC()
+	d.LastSeen = d.LastSeen.UTC()
+	d.ExpiresAt = d.ExpiresAt.UTC()
+	d.Deleted = d.Deleted.UTC()
+}
+
+// previousPort is a port the device stopped registering. It stays listed
+// until the end of the -port-grace, so that clients can drain it.
+type previousPort struct {
+	Port  int       `json:"port"`
+	Until time.Time `json:"until"`
+}
+
+// setPorts replaces the ports of the device, keeping the dropped ones as
+// previous ports during the -port-grace.
+func (d *Device) setPorts(port int, ports []int) {
+	old := d.Ports
+	if len(old) == 0 && d.Port != 0 {
+		old = []int{d.Port}
+	}
+	current := ports
+	if len(current) == 0 && port != 0 {
+		current = []int{port}
+	}
+
+	d.PreviousPorts = slices.DeleteFunc(d.recentPorts(), func(p previousPort) bool {
+		return slices.Contains(current, p.Port)
+	})
+	if portGrace > 0 {
+		until := time.Now().UTC().Add(portGrace)
+		for _, p := range old {
+			if !slices.Contains(current, p) {
+				d.PreviousPorts = append(d.PreviousPorts, previousPort{p, until})
+			}
+		}
+	}
+	d.Port = port
+	d.Ports = ports
+}
+
+// recentPorts returns the previous ports whose grace is not over.
+func (d Device) recentPorts() []previousPort {
+	var recent []previousPort
+	for _, p := range d.PreviousPorts {
+		if time.Now().Before(p.Until) {
+			recent = append(recent, p)
+		}
+	}
+	return recent
+}
+
+// defaultPorts are the ports implied by the schemes clients commonly use.
+var defaultPorts = map[string]int{
+	"http":  80,
+	"https": 443,
+	"ws":    80,
+	"wss":   443,
+	"ftp":   21,
+	"ssh":   22,
+	"mqtt":  1883,
+	"mqtts": 8883,
+}
+
+// effectivePort returns the port to connect to: the registered one or the
+// default of the scheme, 0 when neither is known.
+func (d Device) effectivePort() int {
+	if d.Port != 0 {
+		return d.Port
+	}
+	return defaultPorts[d.Scheme]
+}
+
+// validScheme reports whether s is a URL scheme as defined by RFC 3986.
+func validScheme(s string) bool {
+	for i, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return len(s) <= maxSchemeLength
+}
+
+// stale reports whether the device expires within the -stale-window.
+func (d Device) stale() bool {
+	return staleWindow > 0 && time.Until(d.expiresAt()) <= staleWindow
+}
+
+// ID returns a stable identifier of the device, derived from its addresses
+// and port.
+func (d Device) ID() string {
+	h := sha256.Sum256([]byte(d.ExternalAddress + "|" + d.InternalAddress + "|" + strconv.Itoa(d.Port)))
+	return hex.EncodeToString(h[:8])
+}
+
+// ports is the registration "port" field, either a single port or a list.
+type ports []int
+
+func (p *ports) UnmarshalJSON(b []byte) error {
+	var port int
+	if err := json.Unmarshal(b, &port); err == nil {
+		*p = nil
+		if port != 0 {
+			*p = ports{port}
+		}
+		return nil
+	}
+
+	var l []int
+	if err := json.Unmarshal(b, &l); err != nil {
+		return errors.New(`"port" must be a number or a list of numbers`)
+	}
+	*p = l
+	return nil
+}
+
+// address returns the internal address of the device, with its port if any.
+func (d Device) address() string {
+	if d.Port == 0 {
+		return d.InternalAddress
+	}
+	return net.JoinHostPort(d.InternalAddress, strconv.Itoa(d.Port))
+}
+
+// newToken returns a random device token and the hash to store for it.
+func newToken() (token, hash string, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	token = hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// authorized reports whether the request carries the token of the device.
+// Devices registered before tokens existed have no hash and stay open.
+func (d Device) authorized(r *http.Request) bool {
+	return d.hasToken(r.Header.Get("X-Device-Token"))
+}
+
+// hasToken reports whether token is the token of the device, see authorized.
+func (d Device) hasToken(token string) bool {
+	if d.TokenHash == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(d.TokenHash)) == 1
+}
+
+// errInvalidToken is returned when a registered device is refreshed without
+// its token.
+var errInvalidToken = errors.New("Invalid device token")
+
+// offlineAt returns the time at which the device goes offline, unless it
+// registers again.
+func (d Device) offlineAt() time.Time {
+	e := d.LastSeen.Add(lifetime + d.Extended)
+	if !d.ExpiresAt.IsZero() {
+		e = d.ExpiresAt
+	}
+	if maxLifetime > 0 && d.Added.Add(maxLifetime).Before(e) {
+		return d.Added.Add(maxLifetime)
+	}
+	return e
+}
+
+// expiresAt returns the time at which cleanup removes the device, exactly its
+// expires_at when it registered one.
+func (d Device) expiresAt() time.Time {
+	if !d.Deleted.IsZero() {
+		return d.Deleted.Add(tombstoneWindow)
+	}
+	if !d.ExpiresAt.IsZero() {
+		return d.offlineAt()
+	}
+	return d.offlineAt().Add(offlineGrace + d.jitter())
+}
+
+// expired reports whether cleanup removes the device. Pinned devices are
+// kept however long ago they were seen, until they're unregistered.
+func (d Device) expired() bool {
+	if d.Pinned && d.Deleted.IsZero() {
+		return false
+	}
+	return time.Now().After(d.expiresAt())
+}
+
+// live reports whether the device is registered: neither unregistered nor
+// expired, even when cleanup hasn't removed it yet.
+func (d Device) live() bool {
+	return d.Deleted.IsZero() && !d.expired()
+}
+
+// jitter returns a delay below -expiry-jitter derived from the device, so
+// devices registered together don't all expire in the same cleanup, while
+// each one keeps the same expiry between scans.
+func (d Device) jitter() time.Duration {
+	if expiryJitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, d.ID(), d.Added.UnixNano())
+	return time.Duration(h.Sum64() % uint64(expiryJitter))
+}
+
+// state returns "online", "offline" once its lifetime is over but within the
+// -offline-grace, or "deleted" for tombstones.
+func (d Device) state() string {
+	switch {
+	case !d.Deleted.IsZero():
+		return "deleted"
+	case time.Now().Before(d.offlineAt()):
+		return "online"
+	default:
+		return "offline"
+	}
 }
 
 func main() {
 	flag.DurationVar(&lifetime, "lifetime", lifetime, "Maximal time an object will stay before")
 	flag.StringVar(&httpAddr, "bind", httpAddr, "Bind to the given address:port")
 	flag.StringVar(&dumpPath, "dump", dumpPath, "Location where store/load devices' dumps between restarts")
+	flag.StringVar(&onDumpError, "on-dump-error", onDumpError, "What to do when the dump can't be decoded: fail, ignore or backup (rename it to <dump>.bad)")
+	flag.DurationVar(&cleanupMinInterval, "cleanup-min-interval", cleanupMinInterval, "Minimal time between two cleanup scans, expirations falling within it are coalesced")
+	flag.DurationVar(&tombstoneWindow, "tombstone-window", tombstoneWindow, "How long unregistered devices stay listed with include_deleted=true (0 removes them immediately)")
+	flag.BoolVar(&reusePort, "reuseport", reusePort, "Bind with SO_REUSEPORT so a new instance can take over the port during restarts")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "Token granting access to the admin API (disabled when empty)")
+	flag.StringVar(&webhookURL, "webhook", webhookURL, "URL notified with a POST when devices are added, updated, removed or expire")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "Maximal time to wait for in-flight requests and webhooks on shutdown")
+	flag.BoolVar(&requireScopeToken, "require-scope-token", requireScopeToken, "Require a client chosen scope token to register and list devices, for networks sharing an external IP (CGNAT)")
+	flag.IntVar(&logSampleRate, "log-sample-rate", logSampleRate, "Maximal number of added/updated lines logged per second (0 logs them all)")
+	flag.StringVar(&publicURL, "public-url", publicURL, "Canonical external URL of the service, used in the registration confirmation (defaults to the request host)")
+	flag.StringVar(&allowedHosts, "allowed-hosts", allowedHosts, "Comma separated host names trusted from the Host header in the registration confirmation, without -public-url")
+	flag.IntVar(&registerLimit, "register-limit", registerLimit, "Maximal number of registrations per external IP in each -register-window (0 disables the limit)")
+	flag.DurationVar(&registerWindow, "register-window", registerWindow, "Window over which -register-limit is enforced")
+	flag.DurationVar(&maxLifetime, "max-lifetime", maxLifetime, "Maximal time a device stays after its first registration, even when refreshed (0 means no limit)")
+	flag.DurationVar(&handlerTimeout, "handler-timeout", handlerTimeout, "Maximal time to handle a request before replying 503, except the streamed (NDJSON) device lists (0 means no limit)")
+	flag.BoolVar(&anonymizeIPs, "anonymize-ips", anonymizeIPs, "Log salted hashes instead of IP addresses")
+	flag.StringVar(&anonymizeStrategy, "anonymize-strategy", anonymizeStrategy, "How the admin export anonymizes external addresses: mask (zero the host part) or hash")
+	flag.BoolVar(&noRefreshOnMetadata, "no-refresh-on-metadata-only", noRefreshOnMetadata, "Don't refresh the lifetime of a device when a registration changes any of its fields (name, ports, addresses, location, scheme, path, tags, metadata, capabilities, schema_version, priority or expires_at), only identical registrations refresh it")
+	flag.StringVar(&tenants, "tenants", tenants, "Comma separated list of tenants served under /t/{tenant}/api/")
+	flag.IntVar(&ipv6ScopePrefix, "ipv6-scope-prefix", ipv6ScopePrefix, "Group IPv6 clients by their network prefix of this length instead of their full address, e.g. 64 (0 uses the full address)")
+	flag.DurationVar(&staleWindow, "stale-window", staleWindow, "Devices expiring within this window are listed as stale")
+	flag.BoolVar(&dumpCompress, "dump-compress", dumpCompress, "Compress the dump with gzip (uncompressed dumps are still loaded)")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", snapshotInterval, "Save the dump periodically, not only on shutdown (0 disables snapshots)")
+	flag.BoolVar(&prettyJSON, "pretty-json", prettyJSON, "Indent the JSON device list (also available with ?pretty=true)")
+	flag.DurationVar(&offlineGrace, "offline-grace", offlineGrace, "How long devices stay listed as offline after their lifetime before being deleted")
+	flag.DurationVar(&portGrace, "port-grace", portGrace, "How long the ports a device stops registering stay listed in previous_ports")
+	flag.IntVar(&listenBacklog, "listen-backlog", listenBacklog, "Size of the queue of connections waiting to be accepted, where the platform allows (0 for the system default)")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", proxyProtocol, "Expect a PROXY protocol (v1 or v2) header on each connection, as sent by L4 load balancers")
+	flag.IntVar(&registerConcurrency, "max-concurrent-register", registerConcurrency, "Maximum number of registrations, bulk and batch requests included, handled at once, others are answered 503 (0 for no limit)")
+	flag.IntVar(&listConcurrency, "max-concurrent-list", listConcurrency, "Maximum number of device lists served at once, others are answered 503 (0 for no limit)")
+	flag.IntVar(&maxPortsPerHost, "max-ports-per-host", maxPortsPerHost, "Maximum number of distinct ports registered for an internal address within -ports-window (0 for no limit)")
+	flag.DurationVar(&portsWindow, "ports-window", portsWindow, "Window over which the ports of -max-ports-per-host are counted")
+	flag.StringVar(&portsAction, "ports-action", portsAction, "What to do over -max-ports-per-host: warn (log only) or reject")
+	flag.BoolVar(&selfCheckEnabled, "selfcheck", selfCheckEnabled, "Check at startup that the external address of the clients is resolved through the proxy, with a request to the -public-url")
+	flag.StringVar(&adminStaticDir, "admin-static-dir", adminStaticDir, "Directory of the admin dashboard served at /admin/ (needs -admin-token)")
+	flag.BoolVar(&requirePrivate, "require-private-internal", requirePrivate, "Reject internal addresses which aren't private (RFC 1918 or unique local IPv6)")
+	flag.StringVar(&expireArchive, "expire-archive", expireArchive, "Append expired devices to this file as JSON lines before removing them")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "Maximum size of request bodies")
+	flag.IntVar(&maxBulk, "max-bulk", maxBulk, "Maximum number of devices per bulk registration")
+	flag.StringVar(&signKey, "sign-key", signKey, "Key of the HMAC-SHA256 of the device list returned in the X-Signature header")
+	flag.BoolVar(&requireHTTPS, "require-https", requireHTTPS, "Reject registrations not sent over HTTPS, directly or through the local proxy (X-Forwarded-Proto)")
+	flag.StringVar(&expiryHooks, "expiry-hooks", expiryHooks, "Comma separated <hook>:<tag> rules running a hook (log or webhook) when a device with the tag (* for all) expires")
+	flag.StringVar(&expiryWebhookURL, "expiry-webhook", expiryWebhookURL, "URL the webhook expiry hook posts the expired devices to")
+	flag.DurationVar(&minTTL, "min-ttl", minTTL, "Minimal time until the expires_at of a registration or extension (0 means no limit)")
+	flag.DurationVar(&maxTTL, "max-ttl", maxTTL, "Maximal time until the expires_at of a registration or extension (0 means no limit)")
+	flag.BoolVar(&canaryEnabled, "canary", canaryEnabled, "Register a canary device at startup and check every -canary-interval that it is listed, notifying the -webhook of failures")
+	flag.DurationVar(&canaryInterval, "canary-interval", canaryInterval, "Interval between the checks of the -canary")
+	flag.Float64Var(&massExpiryThreshold, "mass-expiry-threshold", massExpiryThreshold, "Fraction of the devices, e.g. 0.2, over which their expiry in one cleanup is reported as a mass expiry (0 disables it)")
+	flag.StringVar(&massExpiryAction, "mass-expiry-action", massExpiryAction, "How a mass expiry is reported: warn (log) or webhook (log and notify the -webhook)")
+	flag.StringVar(&ttlPolicy, "ttl-policy", ttlPolicy, "What to do with a TTL out of -min-ttl and -max-ttl: clamp it into the range or reject it")
+	flag.IntVar(&cleanupBatch, "cleanup-batch", cleanupBatch, "Maximum number of devices removed at once by the cleanup, which lets registrations through in between (0 for no limit)")
+	flag.BoolVar(&noStatic, "no-static", noStatic, "Serve neither the public directory nor the built-in landing page when it is missing")
+	flag.BoolVar(&allowReset, "allow-reset", allowReset, "Enable POST /api/admin/reset, which removes every device (for test environments)")
+	flag.BoolVar(&allowGetRegister, "allow-get-register", allowGetRegister, "Also accept registrations as GET /api/register with query parameters")
+	flag.StringVar(&faviconPath, "favicon", faviconPath, "Path of the favicon, none is served when empty")
+	flag.DurationVar(&faviconMaxAge, "favicon-max-age", faviconMaxAge, "How long browsers can cache the favicon")
+	flag.BoolVar(&enableDNSSD, "enable-dnssd", enableDNSSD, "Serve the device list as DNS-SD records at /api/devices/dnssd")
+	flag.DurationVar(&expiryJitter, "expiry-jitter", expiryJitter, "Spread the expiry of each device by up to this duration")
+	flag.IntVar(&maxExternalIPs, "max-external-ips", maxExternalIPs, "Maximum number of distinct external addresses holding devices (0 for no limit)")
+	flag.IntVar(&maxMetadataBytes, "max-metadata-bytes", maxMetadataBytes, "Maximum size of the metadata of a device, serialized as JSON")
+	flag.BoolVar(&h2c, "h2c", h2c, "Also serve HTTP/2 without TLS (h2c, with prior knowledge)")
+	flag.BoolVar(&accessLogEnabled, "access-log", accessLogEnabled, "Log each request with its status, size and latency")
+	flag.StringVar(&logLevel, "log-level", logLevel, "Level of the structured logs: debug (with the responses failing to be written), info, warn or error")
+	flag.IntVar(&maxSchemaVersion, "max-schema-version", maxSchemaVersion, "Highest device schema_version accepted from clients")
+	flag.IntVar(&listCacheSeconds, "list-cache-seconds", listCacheSeconds, "How long clients can cache the device list (Cache-Control max-age)")
 	flag.Parse()
 
+	if ipv6ScopePrefix < 0 || ipv6ScopePrefix > 128 {
+		log.Fatal("Invalid -ipv6-scope-prefix value: ", ipv6ScopePrefix)
+	}
+
+	switch onDumpError {
+	case "fail", "ignore", "backup":
+	default:
+		log.Fatal("Invalid -on-dump-error value: ", onDumpError)
+	}
+	rules, err := parseExpiryHooks(expiryHooks)
+	if err != nil {
+		log.Fatal("Invalid -expiry-hooks value: ", err)
+	}
+	expiryRules = rules
+	switch anonymizeStrategy {
+	case "mask", "hash":
+	default:
+		log.Fatal("Invalid -anonymize-strategy value: ", anonymizeStrategy)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		log.Fatal("Invalid -log-level value: ", logLevel)
+	}
+	slog.SetLogLoggerLevel(level)
+	switch portsAction {
+	case "warn", "reject":
+	default:
+		log.Fatal("Invalid -ports-action value: ", portsAction)
+	}
+	switch massExpiryAction {
+	case "warn", "webhook":
+	default:
+		log.Fatal("Invalid -mass-expiry-action value: ", massExpiryAction)
+	}
+	switch ttlPolicy {
+	case "clamp", "reject":
+	default:
+		log.Fatal("Invalid -ttl-policy value: ", ttlPolicy)
+	}
+	if minTTL > 0 && maxTTL > 0 && minTTL > maxTTL {
+		log.Fatal("-min-ttl must not be greater than -max-ttl")
+	}
+	if selfCheckEnabled && publicURL == "" {
+		log.Fatal("-selfcheck needs the -public-url to send its request through the proxy")
+	}
+
+	// Prepare graceful shutdown, signals received while loading included
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
 	if _, err := os.Stat(dumpPath); dumpPath == "" || os.IsNotExist(err) {
-		devices.d = make([]Device, 0)
+		setDevices(make([]Device, 0))
 	} else {
 		log.Println("Resoring states from file: ", dumpPath)
-		devices.d, err = loadDevices(dumpPath)
+		var d []Device
+		d, devices.registrations, err = restoreDevices(dumpPath, onDumpError)
 		if err != nil {
 			log.Fatal("Unable to load saved states:", err)
 		}
+		setDevices(d)
+	}
+
+	// Nothing changed yet, the dump is left as it is.
+	select {
+	case <-interrupt:
+		log.Println("Interrupted while loading the saved states")
+		return
+	default:
 	}
 
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {})
-	http.HandleFunc("/api/register", RegisterDevice)
-	http.HandleFunc("/api/devices", ListDevices)
-	http.Handle("/", http.FileServer(http.Dir("public")))
+	devices.modified = time.Now()
+	reindex()
+	registerRoutes(http.DefaultServeMux)
 
 	go cleanup()
+	if dumpPath != "" && snapshotInterval > 0 {
+		go snapshot(snapshotInterval)
+	}
+	if logSampleRate > 0 {
+		go logSampleSummary(time.Minute)
+	}
 
-	// Prepare graceful shutdown
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	var handler http.Handler = http.DefaultServeMux
+	if handlerTimeout > 0 {
+		handler = timeoutHandler(handler, handlerTimeout)
+	}
+	if accessLogEnabled {
+		handler = accessLog(handler)
+	}
+	if canaryEnabled {
+		go runCanary(handler, canaryInterval)
+	}
 
 	srv := &http.Server{
-		Addr: httpAddr,
+		Addr:    httpAddr,
+		Handler: handler,
+	}
+	if h2c {
+		srv.Protocols = h2cProtocols()
+	}
+
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", httpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if listenBacklog > 0 {
+		if err := setBacklog(ln, listenBacklog); err != nil {
+			log.Println("Unable to set the listen backlog:", err)
+		}
+	}
+	ln = retryListener{ln}
+	if proxyProtocol {
+		ln = proxyListener{ln}
 	}
 
 	// Serve content
 	go func() {
-		log.Fatal(srv.ListenAndServe())
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 	fmt.Println("listen on", httpAddr)
 
+	if selfCheckEnabled {
+		go func() {
+			if err := selfCheck(publicURL); err != nil {
+				log.Printf("Warning: self-check failed: %v. Devices won't be able to register, check the proxy configuration.", err)
+			} else {
+				log.Println("Self-check passed, the external address is resolved through the proxy")
+			}
+		}()
+	}
+
 	// Wait shutdown signal
 	<-interrupt
 
-	log.Print("Saving registered hosts...")
-	if err := saveDevices(dumpPath); err != nil {
-		log.Fatal("error:", err)
+	if dumpPath != "" && dumpUpToDate() {
+		log.Println("Registered hosts already saved")
+	} else if dumpPath != "" {
+		log.Print("Saving registered hosts...")
+		if err := saveDevices(dumpPath); err != nil {
+			log.Fatal("error:", err)
+		}
+		log.Println("done")
 	}
-	log.Println("done")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
 	log.Print("The service is shutting down...")
-	srv.Shutdown(context.Background())
+	srv.Shutdown(ctx)
 	log.Println("done")
-}
-
-func saveDevices(dumpPath string) error {
-	fd, err := os.Create(dumpPath)
-	if err != nil {
-		return err
-	}
-	defer fd.Close()
 
-	devices.RLock()
-	defer devices.RUnlock()
+	log.Print("Waiting for pending webhooks...")
+	closeWebhooks()
+	waitWebhooks(ctx)
+	log.Println("done")
+}
 
-	return gob.NewEncoder(fd).Encode(devices.d)
+// apiRoutes lists the API endpoints along with the methods they accept.
+var apiRoutes = []struct {
+	path    string
+	handler http.HandlerFunc
+	methods []string
+}{
+	{"/api/register", httpsOnly(RegisterDevice), []string{http.MethodPost}},
+	{"/api/register/bulk", httpsOnly(RegisterDevices), []string{http.MethodPost}},
+	{"/api/unregister", UnregisterDevice, []string{http.MethodPost}},
+	{"/api/batch", httpsOnly(Batch), []string{http.MethodPost}},
+	{"/api/devices", ListDevices, []string{http.MethodGet, http.MethodHead}},
+	{"/api/devices/dnssd", ListDNSSD, []string{http.MethodGet, http.MethodHead}},
+	{"/api/device/ttl", DeviceTTL, []string{http.MethodGet, http.MethodHead}},
+	{"/api/device/exists", DeviceExists, []string{http.MethodGet, http.MethodHead}},
+	{"/api/device/extend", ExtendDevice, []string{http.MethodPost}},
+	{"/api/device/pick", PickDevice, []string{http.MethodGet, http.MethodHead}},
+	{"/metrics", Metrics, []string{http.MethodGet, http.MethodHead}},
+	{"/healthz", Healthz, []string{http.MethodGet, http.MethodHead}},
+	{"/readyz", Readyz, []string{http.MethodGet, http.MethodHead}},
+	{"/api/selfcheck", SelfCheck, []string{http.MethodGet, http.MethodHead}},
+	{"/api/admin/ips", adminOnly(ListExternalAddresses), []string{http.MethodGet, http.MethodHead}},
+	{"/api/admin/devices", adminOnly(AdminListDevices), []string{http.MethodGet, http.MethodHead}},
+	{"/api/admin/drain", adminOnly(AdminDrain), []string{http.MethodPost}},
+	{"/api/admin/reset", adminOnly(AdminReset), []string{http.MethodPost}},
+	{"/api/admin/config", adminOnly(AdminConfig), []string{http.MethodGet, http.MethodHead}},
+	{"/api/admin/pin", adminOnly(AdminPin), []string{http.MethodPost}},
 }
 
-func loadDevices(dumpPath string) (d []Device, err error) {
-	var fd *os.File
-	fd, err = os.Open(dumpPath)
-	if err != nil {
+// Favicon serves the -favicon file, cached by browsers for -favicon-max-age.
+func Favicon(w http.ResponseWriter, r *http.Request) {
+	if faviconPath == "" {
+		http.NotFound(w, r)
 		return
 	}
-	defer fd.Close()
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(faviconMaxAge.Seconds())))
+	http.ServeFile(w, r, faviconPath)
+}
 
-	err = gob.NewDecoder(fd).Decode(&d)
+// h2cProtocols serves HTTP/2 without TLS along with HTTP/1.1. Clients must
+// start with HTTP/2 (prior knowledge), the Upgrade from HTTP/1.1 isn't
+// supported.
+func h2cProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
 
-	return
+// isHTTPS reports whether the client sent the request over HTTPS, to the
+// service or to the local proxy, whose X-Forwarded-Proto is trusted like its
+// X-Real-IP.
+func isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || (host != "127.0.0.1" && host != "::1") {
+		return false
+	}
+	return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
 }
 
-func findDevice(ia string, ea string) (int, bool) {
-	for i, d := range devices.d {
-		if d.InternalAddress == ia && d.ExternalAddress == ea {
-			return i, true
+// httpsOnly rejects the requests of h sent over plain HTTP with
+// -require-https, they carry the addresses of the devices.
+func httpsOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requireHTTPS && !isHTTPS(r) {
+			w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+			w.Header().Set("Connection", "Upgrade")
+			http.Error(w, "Please register over HTTPS", http.StatusUpgradeRequired)
+			return
 		}
+		h(w, r)
 	}
-	return -1, false
 }
 
-func devicesFor(ea string) []Device {
-	found := []Device{}
-	for _, d := range devices.d {
-		if d.ExternalAddress == ea {
-			found = append(found, d)
+// timeoutHandler answers 503 to the requests h takes longer than dt to
+// handle. The streamed (NDJSON) device lists are left out: http.TimeoutHandler
+// buffers the whole response, which would defeat the flushes.
+func timeoutHandler(h http.Handler, dt time.Duration) http.Handler {
+	timed := http.TimeoutHandler(h, dt, "Request timed out")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/api/devices") && prefers(r, "application/x-ndjson") {
+			h.ServeHTTP(w, r)
+			return
 		}
-	}
-	return found
+		timed.ServeHTTP(w, r)
+	})
 }
 
-func RegisterDevice(w http.ResponseWriter, r *http.Request) {
-	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, "Please send json", 400)
-		return
+// routeMethods returns the methods allowed on path, adding the optional ones
+// enabled by flags.
+func routeMethods(path string, methods []string) []string {
+	if path == "/api/register" && allowGetRegister {
+		return append(slices.Clip(methods), http.MethodGet)
 	}
+	return methods
+}
 
-	if r.Body == nil {
-		http.Error(w, "Please send a request body", 400)
-		return
+func registerRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/favicon.ico", Favicon)
+	for _, rt := range apiRoutes {
+		h := limitConcurrency(rt.handler, maxConcurrency(rt.path))
+		mux.HandleFunc(rt.path, allowMethods(h, routeMethods(rt.path, rt.methods)...))
 	}
+	mux.HandleFunc("/t/", TenantHandler)
+	mux.HandleFunc("/admin/", AdminUI)
+	mux.Handle("/", staticHandler("public"))
+}
 
-	var t struct {
-		Name    string `json:"name"`
-		Address string `json:"address"`
-		Port    int    `json:"port"`
+// byExternalAddress returns the indexes of the devices of ea, in order, and
+// false when the index is out of date: devices were added or removed since
+// it was built. The devices lock must be held.
+func byExternalAddress(ea string) ([]int, bool) {
+	if devices.byEA == nil || devices.indexedGen != devices.generation {
+		return nil, false
 	}
+	return devices.byEA[ea], true
+}
 
-	err := json.NewDecoder(r.Body).Decode(&t)
-	if err != nil {
-		http.Error(w, err.Error(), 400)
-		return
+// reindex builds the index of the devices by external address. The devices
+// write lock must be held.
+func reindex() {
+	devices.byEA = make(map[string][]int)
+	for i, d := range devices.d {
+		devices.byEA[d.ExternalAddress] = append(devices.byEA[d.ExternalAddress], i)
 	}
+	devices.indexedGen = devices.generation
+}
 
-	t.Address = strings.Trim(t.Address, " ")
+// setDevices replaces the devices, which outdates their index until reindex.
+// Removing devices must go through it. The devices write lock must be held.
+func setDevices(d []Device) {
+	devices.d = d
+	devices.generation++
+}
 
-	if net.ParseIP(t.Address) == nil {
-		http.Error(w, t.Address+" is not a valid IP address", http.StatusBadRequest)
+// addDevice appends d to the devices and to their index. The devices write
+// lock must be held.
+func addDevice(d Device) {
+	_, fresh := byExternalAddress(d.ExternalAddress)
+	setDevices(append(devices.d, d))
+	if !fresh {
+		reindex()
 		return
 	}
+	devices.byEA[d.ExternalAddress] = append(devices.byEA[d.ExternalAddress], len(devices.d)-1)
+	devices.indexedGen = devices.generation
+}
 
-	// Prevent simple loopback mistake
-	if t.Address == "127.0.0.1" || t.Address == "::1" {
-		http.Error(w, `Loopback is not allowed`, http.StatusBadRequest)
-		return
+func findDevice(ia string, o owner) (int, bool) {
+	if is, ok := byExternalAddress(o.ea); ok {
+		for _, i := range is {
+			if d := devices.d[i]; d.InternalAddress == ia && d.ownedBy(o) {
+				return i, true
+			}
+		}
+		return -1, false
 	}
 
-	if net.ParseIP(t.Address) == nil {
-		http.Error(w, `"address" is not a valid IP address`, http.StatusBadRequest)
-		return
+	for i, d := range devices.d {
+		if d.InternalAddress == ia && d.ownedBy(o) {
+			return i, true
+		}
 	}
+	return -1, false
+}
 
-	// TODO: validate parameter name required and no html/js
-	ea, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		http.NotFound(w, r)
-		return
-	}
+// filter selects devices from the query parameters of a list request.
+type filter struct {
+	tags           []string
+	location       string
+	includeDeleted bool
+}
 
-	// Check if proxy was configured.
-	if ea == "127.0.0.1" || ea == "::1" {
-		xrealip := r.Header.Get("x-real-ip")
-		if xrealip != "" {
-			ea = xrealip
-		} else {
-			log.Println(ea, "tried to add an address, this can happen when proxy is not configured correctly.")
-			http.Error(w, `Host `+ea+` is not allowed to register devices`, http.StatusBadRequest)
-			http.NotFound(w, r)
-			return
-		}
+func queryFilter(r *http.Request) filter {
+	q := r.URL.Query()
+	return filter{
+		tags:           q["tag"],
+		location:       q.Get("location"),
+		includeDeleted: q.Get("include_deleted") == "true",
 	}
+}
 
-	devices.Lock()
-	defer devices.Unlock()
-
-	if i, ok := findDevice(t.Address, ea); ok {
-		devices.d[i].Name = t.Name
-		devices.d[i].Port = t.Port
-		devices.d[i].Added = time.Now()
-		log.Println("updated", t.Address)
-	} else {
-		devices.d = append(devices.d, Device{
-			ExternalAddress: ea,
-			InternalAddress: t.Address,
-			Port:            t.Port,
-			Name:            t.Name,
-			Added:           time.Now(),
-		})
-		log.Println("added", t.Address)
+func (f filter) match(d Device) bool {
+	if !f.includeDeleted && !d.Deleted.IsZero() {
+		return false
+	}
+	// Expired devices are left out until cleanup removes them.
+	if d.expired() {
+		return false
 	}
+	if f.location != "" && d.Location != f.location {
+		return false
+	}
+	return d.hasTags(f.tags)
+}
 
-	scheme := r.Header.Get("x-forwarded-proto")
-	if scheme == "" {
-		scheme = "https"
+func devicesFor(o owner, f filter) []Device {
+	found := []Device{}
+	if is, ok := byExternalAddress(o.ea); ok {
+		for _, i := range is {
+			if d := devices.d[i]; d.ownedBy(o) && f.match(d) {
+				found = append(found, d)
+			}
+		}
+		return found
 	}
-	host := r.Header.Get("host")
-	if host == "" {
-		host = "nupnp.com"
+
+	for _, d := range devices.d {
+		if d.ownedBy(o) && f.match(d) {
+			found = append(found, d)
+		}
 	}
+	return found
+}
 
-	fmt.Fprintf(w, "Successfully added, visit %s://%s for more.\n", scheme, host)
+// hasTags reports whether the device carries every one of the given tags.
+func (d Device) hasTags(tags []string) bool {
+	for _, t := range tags {
+		found := false
+		for _, dt := range d.Tags {
+			if dt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
 
-func ListDevices(w http.ResponseWriter, r *http.Request) {
+// errNoProxy is returned by externalAddress when a local connection doesn't
+// carry the headers of a correctly configured proxy.
+var errNoProxy = errors.New("proxy is not configured correctly")
+
+// externalAddress returns the address the request originates from, taking
+// the X-Real-IP header into account when it comes through a local proxy.
+func externalAddress(r *http.Request) (string, error) {
 	ea, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		http.NotFound(w, r)
-		return
+		return "", err
 	}
 
 	// Check if proxy was configured.
 	if ea == "127.0.0.1" || ea == "::1" {
 		xrealip := r.Header.Get("x-real-ip")
-		if xrealip != "" {
-			ea = xrealip
-		} else {
-			log.Println(ea, "tried to access an address, this can happen when proxy is not configured correctly.")
-			http.NotFound(w, r)
-			return
+		if xrealip == "" {
+			return ea, errNoProxy
 		}
+		ea = xrealip
 	}
 
-	devices.RLock()
-	defer devices.RUnlock()
-
-	ds := devicesFor(ea)
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(ds); err != nil {
-		panic(err)
+	// Privacy extensions rotate IPv6 addresses, use their network instead.
+	if ip := net.ParseIP(ea); ipv6ScopePrefix > 0 && ip != nil && ip.To4() == nil {
+		ea = ip.Mask(net.CIDRMask(ipv6ScopePrefix, 128)).String()
 	}
+
+	return ea, nil
 }
 
-func cleanup() {
-	for {
-		firstEvent := time.Now()
-		devices.RLock()
-		for _, d := range devices.d {
-			if firstEvent.After(d.Added) {
-				firstEvent = d.Added
-			}
+// decodeBody decodes the JSON request body into v. It replies with an error
+// and returns false when the body is missing or malformed.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mt != "application/json" && mt != "text/json") {
+		http.Error(w, "Please send json", 400)
+		return false
+	}
+
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return false
+	}
+
+	// Nothing is allocated from the declared length, the body is only read
+	// through MaxBytesReader, but a declared length over the limit is
+	// rejected without reading anything.
+	if r.ContentLength > maxBodyBytes {
+		http.Error(w, fmt.Sprintf("The request body must be at most %d bytes", maxBodyBytes), http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err := dec.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("The request body must be at most %d bytes", maxBodyBytes), http.StatusRequestEntityTooLarge)
+			return false
 		}
-		devices.RUnlock()
+		http.Error(w, err.Error(), 400)
+		return false
+	}
 
-		time.Sleep(firstEvent.Add(lifetime).Add(time.Second).Sub(time.Now()))
+	// Decode stops after the first value, make sure nothing follows it.
+	if _, err := dec.Token(); err != io.EOF {
+		http.Error(w, "Please send a single JSON object", 400)
+		return false
+	}
 
-		devices.Lock()
-		for i := len(devices.d) - 1; i >= 0; i-- {
-			d := devices.d[i]
-			if time.Since(d.Added) > lifetime {
-				log.Println("deleting", devices.d[i].InternalAddress, "(timeout)")
-				devices.d = append(devices.d[:i], devices.d[i+1:]...)
-			}
+	return true
+}
+
+// sanitizeText strips the control characters and surrounding spaces of a
+// user provided text, along with the invisible characters which could make
+// it look like another one in the UI: zero-width and bidi controls.
+func sanitizeText(s string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || invisible(r) {
+			return -1
 		}
-		devices.Unlock()
+		return r
+	}, s))
+}
+
+func invisible(r rune) bool {
+	switch r {
+	case '\u200b', '\u2060', '\ufeff': // zero width space, word joiner, BOM
+		return true
+	}
+	return unicode.In(r, unicode.Bidi_Control, unicode.Join_Control)
+}
+
+// validScope checks the scope token sent by the client. It replies with an
+// error and returns false when it is invalid, or missing when required.
+func validScope(w http.ResponseWriter, scope string) bool {
+	if err := scopeError(scope); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func scopeError(scope string) error {
+	if scope == "" && requireScopeToken {
+		return errors.New(`Please send a "scope" token`)
+	}
+	if len(scope) > maxScopeLength {
+		return fmt.Errorf("The scope token must be at most %d characters", maxScopeLength)
+	}
+	return nil
+}
+
+// registration is the body of a registration request.
+type registration struct {
+	Name      string            `json:"name"`
+	Address   string            `json:"address"`
+	Addresses []string          `json:"addresses"`
+	Ports     ports             `json:"port"`
+	Tags      []string          `json:"tags"`
+	Scope     string            `json:"scope"`
+	Location  string            `json:"location"`
+	Scheme    string            `json:"scheme"`
+	Path      string            `json:"path"`
+	Metadata  map[string]string `json:"metadata"`
+	Caps      *Capabilities     `json:"capabilities"`
+	Schema    int               `json:"schema_version"`
+	Expires   time.Time         `json:"expires_at"`
+	Priority  int               `json:"priority"`
+	// Only register when the network doesn't have a device with this name or
+	// address yet, to claim a slot.
+	OnlyIfAbsent bool `json:"only_if_absent"`
+	// Never expire the device, only allowed with the admin token.
+	Pinned bool `json:"pinned"`
+	// Token of the device to refresh, defaults to the X-Device-Token header.
+	Token string `json:"token"`
+	// Set for the canary, see isCanary.
+	canary bool
+}
+
+// token returns the token sent to refresh the device.
+func (t registration) token(r *http.Request) string {
+	if t.Token != "" {
+		return t.Token
+	}
+	return r.Header.Get("X-Device-Token")
+}
+
+// addressError checks an internal address of a device. The error is meant
+// for the client.
+func addressError(address string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return errors.New(address + " is not a valid IP address")
+	}
+
+	// Prevent simple mistakes, these addresses can't be reached from another host
+	switch {
+	case ip.IsLoopback():
+		return errors.New(`Loopback is not allowed`)
+	case ip.IsUnspecified():
+		return errors.New(address + ` is the unspecified address, not the address of the device`)
+	case ip.IsLinkLocalUnicast():
+		return errors.New(address + ` is a link-local address, which is only valid on its link`)
+	case ip.IsMulticast():
+		return errors.New(address + ` is a multicast address, not the address of a device`)
+	}
+
+	if requirePrivate && !ip.IsPrivate() {
+		return errors.New(address + ` is a public address, "address" must be the private address of the device in its network`)
+	}
+	return nil
+}
+
+// boundTTL applies -min-ttl and -max-ttl to a TTL chosen by a client,
+// clamping it or returning an error for the client, per -ttl-policy.
+func boundTTL(ttl time.Duration) (time.Duration, error) {
+	bounded := ttl
+	if minTTL > 0 && bounded < minTTL {
+		bounded = minTTL
+	}
+	if maxTTL > 0 && bounded > maxTTL {
+		bounded = maxTTL
+	}
+	if bounded != ttl && ttlPolicy == "reject" {
+		return 0, fmt.Errorf("The TTL must be between %v and %v", minTTL, maxTTL)
+	}
+	return bounded, nil
+}
+
+// validate normalizes the registration and checks it. The error is meant
+// for the client.
+func (t *registration) validate() error {
+	if t.Schema == 0 {
+		t.Schema = 1
+	}
+	if t.Schema < 1 || t.Schema > maxSchemaVersion {
+		return fmt.Errorf(`"schema_version" %d is not supported, the maximum is %d`, t.Schema, maxSchemaVersion)
+	}
+
+	if !t.Expires.IsZero() && !t.Expires.After(time.Now()) {
+		return errors.New(`"expires_at" must be in the future`)
+	}
+	if !t.Expires.IsZero() {
+		ttl := time.Until(t.Expires)
+		bounded, err := boundTTL(ttl)
+		if err != nil {
+			return err
+		}
+		if bounded != ttl {
+			t.Expires = time.Now().Add(bounded)
+		}
+	}
+	t.Expires = t.Expires.UTC()
+
+	if t.Priority < -maxPriority || t.Priority > maxPriority {
+		return fmt.Errorf(`"priority" must be between %d and %d`, -maxPriority, maxPriority)
+	}
+
+	t.Scheme = strings.ToLower(strings.TrimSpace(t.Scheme))
+	if !validScheme(t.Scheme) {
+		return errors.New(`"scheme" is not a valid URL scheme`)
+	}
+
+	t.Name = nfc(sanitizeText(t.Name))
+	if len(t.Name) > maxNameLength {
+		return fmt.Errorf(`"name" must be at most %d characters`, maxNameLength)
+	}
+	t.Location = sanitizeText(t.Location)
+	if len(t.Location) > maxLocationLength {
+		return fmt.Errorf(`"location" must be at most %d characters`, maxLocationLength)
+	}
+
+	t.Path = sanitizeText(t.Path)
+	if t.Path != "" && !strings.HasPrefix(t.Path, "/") {
+		return errors.New(`"path" must start with /`)
+	}
+	if len(t.Path) > maxPathLength {
+		return fmt.Errorf(`"path" must be at most %d characters`, maxPathLength)
+	}
+
+	if err := scopeError(t.Scope); err != nil {
+		return err
+	}
+
+	for _, p := range t.Ports {
+		if p < 1 || p > 65535 {
+			return fmt.Errorf("%d is not a valid port", p)
+		}
+	}
+
+	t.Address = strings.Trim(t.Address, " ")
+	if t.Address == "" && len(t.Addresses) > 0 {
+		t.Address = strings.Trim(t.Addresses[0], " ")
+	}
+	if err := addressError(t.Address); err != nil {
+		return err
+	}
+
+	// The primary address comes first, the list is only kept with others.
+	if len(t.Addresses) > maxAddresses {
+		return fmt.Errorf(`At most %d "addresses" are allowed`, maxAddresses)
+	}
+	addresses := []string{t.Address}
+	for _, a := range t.Addresses {
+		a = strings.Trim(a, " ")
+		if err := addressError(a); err != nil {
+			return err
+		}
+		if !slices.Contains(addresses, a) {
+			addresses = append(addresses, a)
+		}
+	}
+	t.Addresses = nil
+	if len(addresses) > 1 {
+		t.Addresses = addresses
+	}
+
+	if len(t.Metadata) > 0 {
+		b, err := json.Marshal(t.Metadata)
+		if err != nil {
+			return err
+		}
+		if len(b) > maxMetadataBytes {
+			return fmt.Errorf(`"metadata" must be at most %d bytes once serialized`, maxMetadataBytes)
+		}
+	}
+
+	if err := t.Caps.validate(); err != nil {
+		return err
+	}
+
+	if len(t.Tags) > maxTags {
+		return fmt.Errorf("At most %d tags are allowed", maxTags)
+	}
+	for i, tag := range t.Tags {
+		tag = strings.Trim(tag, " ")
+		if tag == "" || len(tag) > maxTagLength {
+			return fmt.Errorf("Tags must be between 1 and %d characters", maxTagLength)
+		}
+		t.Tags[i] = tag
+	}
+
+	return nil
+}
+
+// port returns the main port of the device, the first one registered.
+func (t registration) port() int {
+	if len(t.Ports) > 0 {
+		return t.Ports[0]
+	}
+	return 0
+}
+
+// registrant returns the external address registering devices, once it is
+// allowed to. It replies with an error and returns false otherwise.
+func registrant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ea, err := externalAddress(r)
+	if err == errNoProxy {
+		log.Println(logIP(ea), "tried to add an address, this can happen when proxy is not configured correctly.")
+		http.Error(w, `Host `+ea+` is not allowed to register devices`, http.StatusBadRequest)
+		return "", false
+	} else if err != nil {
+		http.NotFound(w, r)
+		return "", false
+	}
+
+	if ok, retry := allowRegister(ea); !ok {
+		tooManyRequests(w, r, retry)
+		return "", false
+	}
+	return ea, true
+}
+
+// errDeviceExists is returned when registering only_if_absent a device whose
+// name or address is already registered.
+var errDeviceExists = errors.New("A device with this name or address is already registered")
+
+// errPinning is returned when a registration asks to be pinned without the
+// admin token.
+var errPinning = errors.New("Only the admin can pin devices")
+
+// claimed reports whether the owner already has a device with the name or
+// the address of the registration. The devices lock must be held.
+func claimed(t registration, o owner) bool {
+	for _, d := range devicesFor(o, filter{}) {
+		if d.InternalAddress == t.Address || (t.Name != "" && d.Name == t.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// errTooManyNetworks is returned when registering a device for a new
+// external address while already at -max-external-ips.
+var errTooManyNetworks = errors.New("Too many networks are using the service, try again later")
+
+// externalAddresses returns the number of distinct external addresses
+// holding live devices, tombstones aside, and whether ea is one of them. The
+// devices lock must be held.
+func externalAddresses(ea string) (int, bool) {
+	if _, fresh := byExternalAddress(ea); fresh {
+		n := 0
+		for _, is := range devices.byEA {
+			if liveIn(is) {
+				n++
+			}
+		}
+		return n, liveIn(devices.byEA[ea])
+	}
+
+	seen := map[string]bool{}
+	for _, d := range devices.d {
+		if d.live() {
+			seen[d.ExternalAddress] = true
+		}
+	}
+	return len(seen), seen[ea]
+}
+
+// liveIn reports whether one of the devices at the indexes is live, it is
+// usually the first one.
+func liveIn(is []int) bool {
+	return slices.ContainsFunc(is, func(i int) bool { return devices.d[i].live() })
+}
+
+// register adds the device, or refreshes it when it is already registered,
+// which requires its token: other hosts of the network can't take it over.
+// It returns the device token when the device is added, or registered again
+// after it was unregistered. The devices lock must be held.
+func register(t registration, ea, tenant, token string) (string, error) {
+	if t.OnlyIfAbsent && claimed(t, owner{ea, t.Scope, tenant}) {
+		return "", errDeviceExists
+	}
+	// The ports are only recorded once the registration is accepted, so that
+	// refused ones can't push the host over the limit.
+	if !checkPorts(ea, t.Address, t.Ports) {
+		return "", errTooManyPorts
+	}
+
+	port := t.port()
+	if i, ok := findDevice(t.Address, owner{ea, t.Scope, tenant}); ok {
+		d := &devices.d[i]
+		if d.Deleted.IsZero() && !d.hasToken(token) {
+			return "", errInvalidToken
+		}
+		// The previous token was given up with the device.
+		var issued string
+		if !d.Deleted.IsZero() {
+			var hash string
+			var err error
+			if issued, hash, err = newToken(); err != nil {
+				return "", err
+			}
+			d.TokenHash = hash
+		}
+		recordPorts(ea, t.Address, t.Ports)
+		// Registrations changing any field don't refresh the device with
+		// -no-refresh-on-metadata-only.
+		fieldsChanged := d.Deleted.IsZero() && (d.Name != t.Name || d.Port != port || d.Location != t.Location || d.Scheme != t.Scheme || d.Path != t.Path ||
+			!slices.Equal(d.Ports, t.Ports) || !slices.Equal(d.Addresses, t.Addresses) || !slices.Equal(d.Tags, t.Tags) || !maps.Equal(d.Metadata, t.Metadata) || !equalCapabilities(d.Capabilities, t.Caps) || d.SchemaVersion != t.Schema || d.Priority != t.Priority || !d.ExpiresAt.Equal(t.Expires))
+
+		d.Name = t.Name
+		d.Location = t.Location
+		d.Path = t.Path
+		d.Scheme = t.Scheme
+		d.Metadata = t.Metadata
+		d.Capabilities = t.Caps
+		d.Addresses = t.Addresses
+		d.SchemaVersion = t.Schema
+		d.Priority = t.Priority
+		d.ExpiresAt = t.Expires
+		d.setPorts(port, t.Ports)
+		d.Tags = t.Tags
+		if !fieldsChanged || !noRefreshOnMetadata {
+			d.LastSeen = time.Now().UTC()
+			d.Extended = 0
+		}
+		d.Deleted = time.Time{}
+		// Refreshes don't repeat pinned, only the admin unpins.
+		d.Pinned = d.Pinned || t.Pinned
+		if !t.canary {
+			logSampled("updated", logIP(t.Address))
+			devices.registrations++
+			changed()
+			notify("updated", devices.d[i])
+		}
+		scheduleExpiry(devices.d[i])
+		return issued, nil
+	}
+
+	if maxExternalIPs > 0 {
+		if n, known := externalAddresses(ea); !known && n >= maxExternalIPs {
+			log.Println("rejecting", logIP(ea)+": already", n, "external addresses")
+			return "", errTooManyNetworks
+		}
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	recordPorts(ea, t.Address, t.Ports)
+	now := time.Now().UTC()
+	addDevice(Device{
+		ExternalAddress: ea,
+		InternalAddress: t.Address,
+		Port:            port,
+		Ports:           t.Ports,
+		Name:            t.Name,
+		Added:           now,
+		LastSeen:        now,
+		Tags:            t.Tags,
+		Location:        t.Location,
+		Path:            t.Path,
+		Scheme:          t.Scheme,
+		Metadata:        t.Metadata,
+		Capabilities:    t.Caps,
+		Addresses:       t.Addresses,
+		SchemaVersion:   t.Schema,
+		Priority:        t.Priority,
+		ExpiresAt:       t.Expires,
+		Pinned:          t.Pinned,
+		TokenHash:       hash,
+		Scope:           t.Scope,
+		Tenant:          tenant,
+	})
+	if !t.canary {
+		logSampled("added", logIP(t.Address))
+		devices.registrations++
+		changed()
+		notify("added", devices.d[len(devices.d)-1])
+	}
+	scheduleExpiry(devices.d[len(devices.d)-1])
+	return token, nil
+}
+
+// queryRegistration reads a registration from the query parameters of a GET
+// request, for clients unable to send a JSON body. It replies with an error
+// and returns false when they are malformed.
+func queryRegistration(w http.ResponseWriter, r *http.Request, t *registration) bool {
+	q := r.URL.Query()
+	for _, v := range q["port"] {
+		for _, p := range strings.Split(v, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				http.Error(w, p+" is not a valid port", http.StatusBadRequest)
+				return false
+			}
+			t.Ports = append(t.Ports, port)
+		}
+	}
+
+	t.Name = q.Get("name")
+	t.Address = q.Get("address")
+	t.Tags = q["tag"]
+	t.Scope = q.Get("scope")
+	t.Location = q.Get("location")
+	t.Scheme = q.Get("scheme")
+	t.Path = q.Get("path")
+	if v := q.Get("expires_at"); v != "" {
+		var err error
+		if t.Expires, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, `"expires_at" must be an RFC 3339 time`, http.StatusBadRequest)
+			return false
+		}
+	}
+	if v := q.Get("schema_version"); v != "" {
+		var err error
+		if t.Schema, err = strconv.Atoi(v); err != nil {
+			http.Error(w, `"schema_version" must be a number`, http.StatusBadRequest)
+			return false
+		}
+	}
+	t.OnlyIfAbsent = q.Get("only_if_absent") == "true"
+	t.Pinned = q.Get("pinned") == "true"
+	if v := q.Get("priority"); v != "" {
+		var err error
+		if t.Priority, err = strconv.Atoi(v); err != nil {
+			http.Error(w, `"priority" must be a number`, http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+func RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	var t registration
+	if r.Method == http.MethodGet {
+		// Registering must not be cached like reads are.
+		w.Header().Set("Cache-Control", "no-store")
+		if !queryRegistration(w, r, &t) {
+			return
+		}
+	} else if !decodeBody(w, r, &t) {
+		return
+	}
+
+	if err := t.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t.Pinned && !isAdmin(r) {
+		http.Error(w, errPinning.Error(), http.StatusForbidden)
+		return
+	}
+
+	// TODO: validate parameter name required and no html/js
+	ea, ok := registrant(w, r)
+	if !ok {
+		return
+	}
+	t.canary = isCanary(r)
+
+	devices.Lock()
+	defer devices.Unlock()
+
+	token, err := register(t, ea, tenantOf(r), t.token(r))
+	if err == errTooManyNetworks {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err == errInvalidToken {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err == errTooManyPorts {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	} else if err == errDeviceExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Unable to generate a device token", http.StatusInternalServerError)
+		return
+	}
+	if token != "" {
+		w.Header().Set("X-Device-Token", token)
+	}
+	if i, ok := findDevice(t.Address, owner{ea, t.Scope, tenantOf(r)}); ok {
+		w.Header().Set("X-Device-TTL", strconv.FormatInt(int64(time.Until(devices.d[i].offlineAt())/time.Second), 10))
+	}
+
+	if _, err := fmt.Fprintf(w, "Successfully added, visit %s for more.\n", publicBaseURL(r)); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+// publicBaseURL returns the URL users should visit to see their devices:
+// the configured public URL, or else the one the request was sent to when
+// its host is one of the -allowed-hosts. The Host and X-Forwarded-Proto
+// headers are chosen by the client, reflecting any of them would let it
+// craft phishing links.
+func publicBaseURL(r *http.Request) string {
+	if publicURL != "" {
+		return publicURL
+	}
+
+	// Only the local proxy may tell the request was sent over plain HTTP.
+	scheme := "https"
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && (host == "127.0.0.1" || host == "::1") && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "http") {
+		scheme = "http"
+	}
+	host := r.Host
+	if !allowedHost(host) {
+		host = httpAddr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+	}
+
+	return scheme + "://" + host
+}
+
+// allowedHost reports whether host, with or without its port, is one of the
+// -allowed-hosts.
+func allowedHost(host string) bool {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	for _, allowed := range strings.Split(allowedHosts, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed != "" && (strings.EqualFold(allowed, host) || strings.EqualFold(allowed, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func UnregisterDevice(w http.ResponseWriter, r *http.Request) {
+	var t struct {
+		Address string `json:"address"`
+		Scope   string `json:"scope"`
+	}
+
+	if !decodeBody(w, r, &t) {
+		return
+	}
+
+	if !validScope(w, t.Scope) {
+		return
+	}
+
+	t.Address = strings.Trim(t.Address, " ")
+
+	ea, err := externalAddress(r)
+	if err == errNoProxy {
+		log.Println(logIP(ea), "tried to remove an address, this can happen when proxy is not configured correctly.")
+		http.Error(w, `Host `+ea+` is not allowed to unregister devices`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	devices.Lock()
+	defer devices.Unlock()
+
+	i, ok := findDevice(t.Address, owner{ea, t.Scope, tenantOf(r)})
+	if !ok || !devices.d[i].live() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !devices.d[i].authorized(r) {
+		http.Error(w, "Invalid device token", http.StatusForbidden)
+		return
+	}
+
+	d := devices.d[i]
+	if tombstoneWindow > 0 {
+		devices.d[i].Deleted = time.Now().UTC()
+		scheduleExpiry(devices.d[i])
+	} else {
+		setDevices(append(devices.d[:i], devices.d[i+1:]...))
+		reindex()
+	}
+	log.Println("removed", logIP(t.Address))
+	changed()
+	notify("removed", d)
+
+	if _, err := fmt.Fprintln(w, "Successfully removed."); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+// writeFailed logs, at debug level, a response which couldn't be written,
+// usually because the client went away. Nothing more can be sent to it.
+func writeFailed(r *http.Request, err error) {
+	slog.Debug("unable to write the response",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"request_id", r.Header.Get("X-Request-ID"),
+		"err", err)
+}
+
+// writeJSON replies v as JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+// prefers reports whether the Accept header of r gives mediaType a higher
+// quality than application/json, the default of the API. Each type takes
+// the quality of the most specific range it matches (RFC 9110 12.5.1).
+func prefers(r *http.Request, mediaType string) bool {
+	ranges := strings.Split(strings.Join(r.Header.Values("Accept"), ","), ",")
+	return acceptQuality(ranges, mediaType) > acceptQuality(ranges, "application/json")
+}
+
+// acceptQuality returns the quality the media ranges of an Accept header
+// give to mediaType, 0 when none matches.
+func acceptQuality(ranges []string, mediaType string) float64 {
+	quality, specificity := 0.0, 0
+	for _, rg := range ranges {
+		mt, params, err := mime.ParseMediaType(rg)
+		if err != nil {
+			continue
+		}
+		s := 0
+		switch {
+		case mt == mediaType:
+			s = 3
+		case strings.HasSuffix(mt, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mt, "*")):
+			s = 2
+		case mt == "*/*":
+			s = 1
+		}
+		if s <= specificity {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+// allowMethods restricts h to the given methods, replying 405 otherwise. OPTIONS
+// requests get the allowed methods.
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allow+", "+http.MethodOptions)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// queryOwner returns the owner of the devices a read request is about, from
+// its external address and "scope" query parameter. It replies with an
+// error and returns false when they are invalid.
+func queryOwner(w http.ResponseWriter, r *http.Request) (owner, bool) {
+	ea, err := externalAddress(r)
+	if err != nil {
+		if err == errNoProxy {
+			log.Println(logIP(ea), "tried to access an address, this can happen when proxy is not configured correctly.")
+		}
+		http.NotFound(w, r)
+		return owner{}, false
+	}
+
+	scope := r.URL.Query().Get("scope")
+	if !validScope(w, scope) {
+		return owner{}, false
+	}
+
+	return owner{ea, scope, tenantOf(r)}, true
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body with the -sign-key. The
+// body is signed exactly as it is sent, there is no canonicalization.
+func sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signKey))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sortDevices orders ds as asked by the "sort" query parameter: "priority"
+// lists the highest priority first. It replies with an error and returns
+// false for an unknown order.
+func sortDevices(w http.ResponseWriter, r *http.Request, ds []Device) ([]Device, bool) {
+	switch r.URL.Query().Get("sort") {
+	case "":
+	case "priority":
+		slices.SortStableFunc(ds, func(a, b Device) int {
+			return b.Priority - a.Priority
+		})
+	default:
+		http.Error(w, `"sort" must be "priority"`, http.StatusBadRequest)
+		return nil, false
+	}
+	return ds, true
+}
+
+// sortNear lists first the devices whose internal address is within the
+// "near" query parameter, a CIDR or "auto" for the network of the caller. The
+// order is otherwise kept. It replies with an error and returns false when
+// the parameter is invalid.
+func sortNear(w http.ResponseWriter, r *http.Request, ds []Device) ([]Device, bool) {
+	near := r.URL.Query().Get("near")
+	if near == "" {
+		return ds, true
+	}
+
+	var network *net.IPNet
+	if near == "auto" {
+		// Best-effort: the caller's own address only shares a network with
+		// the devices when it reaches the service from inside it.
+		ea, _ := externalAddress(r)
+		ip := net.ParseIP(ea)
+		if ip == nil {
+			return ds, true
+		}
+		if ip.To4() != nil {
+			network = &net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		} else {
+			network = &net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+		}
+	} else {
+		var err error
+		if _, network, err = net.ParseCIDR(near); err != nil {
+			http.Error(w, `"near" must be a CIDR or "auto"`, http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	slices.SortStableFunc(ds, func(a, b Device) int {
+		an := network.Contains(net.ParseIP(a.InternalAddress))
+		bn := network.Contains(net.ParseIP(b.InternalAddress))
+		switch {
+		case an && !bn:
+			return -1
+		case bn && !an:
+			return 1
+		}
+		return 0
+	})
+	return ds, true
+}
+
+// paginate returns the page of ds selected by the "limit" and "offset" query
+// parameters, and links the previous and next pages in a Link header
+// (RFC 8288). It replies with an error and returns false when they are
+// invalid.
+func paginate(w http.ResponseWriter, r *http.Request, ds []Device) ([]Device, bool) {
+	q := r.URL.Query()
+	if q.Get("limit") == "" && q.Get("offset") == "" {
+		return ds, true
+	}
+
+	limit, offset := len(ds), 0
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, `"limit" must be a positive number`, http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			http.Error(w, `"offset" must be a positive number`, http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	path := r.URL.Path
+	if tenant := tenantOf(r); tenant != "" {
+		path = "/t/" + tenant + path
+	}
+	link := func(offset int, rel string) string {
+		q.Set("offset", strconv.Itoa(offset))
+		q.Set("limit", strconv.Itoa(limit))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, path, q.Encode(), rel)
+	}
+	var links []string
+	if offset > 0 {
+		links = append(links, link(max(offset-limit, 0), "prev"))
+	}
+	if offset+limit < len(ds) {
+		links = append(links, link(offset+limit, "next"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	ds = ds[min(offset, len(ds)):]
+	return ds[:min(limit, len(ds))], true
+}
+
+// listModified returns the last time the list of ds changed: the last
+// change of the devices, or a device going offline or stale since. The
+// devices lock must be held.
+func listModified(ds []Device) time.Time {
+	modified := devices.modified
+	now := time.Now()
+	for _, d := range ds {
+		for _, t := range []time.Time{d.offlineAt(), d.expiresAt().Add(-staleWindow)} {
+			if t.Before(now) && t.After(modified) {
+				modified = t
+			}
+		}
+	}
+	return modified
+}
+
+// notModified reports whether the client already has the response, from
+// its If-None-Match header or else its If-Modified-Since header.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(ims)
+}
+
+// ndjsonFlush is the number of devices streamed between flushes.
+const ndjsonFlush = 100
+
+// streamDevices writes one JSON device per line, flushing as it goes so
+// consumers process large lists incrementally.
+func streamDevices(w http.ResponseWriter, r *http.Request, ds []Device, fields projection) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for i, d := range ds {
+		v, err := fields.apply(d)
+		if err == nil {
+			err = enc.Encode(v)
+		}
+		if err != nil {
+			writeFailed(r, err)
+			return
+		}
+		if (i+1)%ndjsonFlush == 0 {
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				writeFailed(r, err)
+				return
+			}
+		}
+	}
+}
+
+func ListDevices(w http.ResponseWriter, r *http.Request) {
+	o, ok := queryOwner(w, r)
+	if !ok {
+		return
+	}
+	fields, ok := queryFields(w, r)
+	if !ok {
+		return
+	}
+
+	devices.RLock()
+	ds := devicesFor(o, queryFilter(r))
+	modified := listModified(ds)
+	devices.RUnlock()
+
+	if r.URL.Query().Get("include_lifetime") == "true" {
+		now := time.Now()
+		for i := range ds {
+			ds[i].listedAt = now
+		}
+	}
+
+	total := len(ds)
+	if ds, ok = sortDevices(w, r, ds); !ok {
+		return
+	}
+	if ds, ok = sortNear(w, r, ds); !ok {
+		return
+	}
+	ds, ok = paginate(w, r, ds)
+	if !ok {
+		return
+	}
+
+	if prefers(r, "application/x-ndjson") {
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		streamDevices(w, r, ds, fields)
+		return
+	}
+
+	var body bytes.Buffer
+	if r.URL.Query().Get("fields") == "address" || prefers(r, "text/plain") {
+		// Plain list of addresses, handy for scripts.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, d := range ds {
+			fmt.Fprintln(&body, d.address())
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(&body)
+		if prettyJSON || r.URL.Query().Get("pretty") == "true" {
+			enc.SetIndent("", "  ")
+		}
+		v, err := fields.applyAll(ds)
+		if err == nil {
+			err = enc.Encode(v)
+		}
+		if err != nil {
+			log.Println("Unable to encode the device list:", err)
+			http.Error(w, "Unable to list the devices", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h := sha256.Sum256(body.Bytes())
+	etag := `"` + hex.EncodeToString(h[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if signKey != "" {
+		w.Header().Set("X-Signature", "sha256="+sign(body.Bytes()))
+	}
+	// The list depends on the caller, shared caches must not keep it.
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", listCacheSeconds))
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := body.WriteTo(w); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+// DeviceTTL tells a device how long until it expires.
+func DeviceTTL(w http.ResponseWriter, r *http.Request) {
+	o, ok := queryOwner(w, r)
+	if !ok {
+		return
+	}
+
+	devices.RLock()
+	i, ok := findDevice(strings.Trim(r.URL.Query().Get("address"), " "), o)
+	var expires time.Time
+	if ok {
+		ok = devices.d[i].live()
+		expires = devices.d[i].expiresAt()
+	}
+	devices.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	remaining := time.Until(expires)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	writeJSON(w, r, struct {
+		ExpiresIn int64 `json:"expires_in_seconds"`
+	}{int64(remaining / time.Second)})
+}
+
+// ExtendDevice pushes the expiry of a device back by the given number of
+// seconds, still bounded by -max-lifetime, and returns the new expiry.
+func ExtendDevice(w http.ResponseWriter, r *http.Request) {
+	var t struct {
+		Address string `json:"address"`
+		Scope   string `json:"scope"`
+		Seconds int64  `json:"seconds"`
+	}
+
+	if !decodeBody(w, r, &t) {
+		return
+	}
+
+	if !validScope(w, t.Scope) {
+		return
+	}
+	if t.Seconds < 1 || t.Seconds > int64(math.MaxInt64/time.Second) {
+		http.Error(w, `"seconds" must be a positive number`, http.StatusBadRequest)
+		return
+	}
+
+	t.Address = strings.Trim(t.Address, " ")
+
+	ea, err := externalAddress(r)
+	if err == errNoProxy {
+		log.Println(logIP(ea), "tried to extend an address, this can happen when proxy is not configured correctly.")
+		http.Error(w, `Host `+ea+` is not allowed to extend devices`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	devices.Lock()
+	defer devices.Unlock()
+
+	i, ok := findDevice(t.Address, owner{ea, t.Scope, tenantOf(r)})
+	if !ok || !devices.d[i].live() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !devices.d[i].authorized(r) {
+		http.Error(w, "Invalid device token", http.StatusForbidden)
+		return
+	}
+
+	d := &devices.d[i]
+	extension := time.Duration(t.Seconds) * time.Second
+	if maxTTL > 0 || minTTL > 0 {
+		ttl := time.Until(d.offlineAt())
+		bounded, err := boundTTL(ttl + extension)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		extension = max(bounded-ttl, 0)
+	}
+	if !d.ExpiresAt.IsZero() {
+		d.ExpiresAt = d.ExpiresAt.Add(extension)
+	} else {
+		d.Extended += extension
+	}
+	changed()
+
+	writeJSON(w, r, struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}{devices.d[i].expiresAt().UTC()})
+}
+
+// DeviceExists replies 204 when the device is registered for the caller, 404
+// otherwise, without a body.
+func DeviceExists(w http.ResponseWriter, r *http.Request) {
+	o, ok := queryOwner(w, r)
+	if !ok {
+		return
+	}
+
+	devices.RLock()
+	i, ok := findDevice(strings.Trim(r.URL.Query().Get("address"), " "), o)
+	ok = ok && devices.d[i].live()
+	devices.RUnlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cleanupWake interrupts the cleanup sleep so the next expiry is rescheduled.
+var cleanupWake = make(chan struct{}, 1)
+
+func wakeCleanup() {
+	select {
+	case cleanupWake <- struct{}{}:
+	default:
+	}
+}
+
+// cleanupDeadline is the time of the next scan of the sleeping cleanup, in
+// Unix nanoseconds, 0 until it is scheduled.
+var cleanupDeadline atomic.Int64
+
+// scheduleExpiry wakes the cleanup up when d expires before its next scan,
+// e.g. with an expires_at sooner than the lifetime, so that d is removed on
+// time.
+func scheduleExpiry(d Device) {
+	if d.Pinned && d.Deleted.IsZero() {
+		return
+	}
+	deadline := cleanupDeadline.Load()
+	// Nothing is gained within the minimal interval between scans.
+	if deadline == 0 || d.expiresAt().UnixNano() < deadline && time.Until(time.Unix(0, deadline)) > cleanupMinInterval {
+		wakeCleanup()
+	}
+}
+
+// nextCleanup returns how long cleanup should sleep before its next scan.
+func nextCleanup() time.Duration {
+	next := time.Now().Add(lifetime)
+	devices.RLock()
+	for _, d := range devices.d {
+		if d.Pinned && d.Deleted.IsZero() {
+			continue
+		}
+		if e := d.expiresAt(); e.Before(next) {
+			next = e
+		}
+	}
+	devices.RUnlock()
+
+	wait := next.Add(time.Second).Sub(time.Now())
+	if wait < cleanupMinInterval {
+		wait = cleanupMinInterval
+	}
+	return wait
+}
+
+func cleanup() {
+	for {
+		wait := nextCleanup()
+		cleanupDeadline.Store(time.Now().Add(wait).UnixNano())
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-cleanupWake:
+			timer.Stop()
+			continue
+		}
+
+		expire()
+	}
+}
+
+// expire removes the expired devices and tombstones, archiving them when
+// -expire-archive is set. They are looked for under the read lock, so that
+// registrations and lists aren't held up by the scan.
+func expire() {
+	devices.RLock()
+	candidates := map[deviceKey]time.Time{}
+	purge := false
+	live := 0
+	for _, d := range devices.d {
+		if d.Deleted.IsZero() {
+			live++
+		}
+		if d.expired() {
+			candidates[d.key()] = d.Added
+		} else if len(d.recentPorts()) != len(d.PreviousPorts) {
+			purge = true
+		}
+	}
+	devices.RUnlock()
+
+	before := expiredTotal.Load()
+	if len(candidates) > 0 || purge {
+		expireDevices(candidates)
+	}
+	checkMassExpiry(int(expiredTotal.Load()-before), live)
+}
+
+// deviceKey identifies a device across critical sections, unlike its index.
+type deviceKey struct {
+	owner
+	address string
+}
+
+func (d Device) key() deviceKey {
+	return deviceKey{owner{d.ExternalAddress, d.Scope, d.Tenant}, d.InternalAddress}
+}
+
+// expireDevices removes the candidates found by expire. Each one is checked
+// again under the write lock: a device refreshed or re-added since the scan
+// is kept. They are removed by batches of -cleanup-batch, releasing the lock
+// in between so that registrations aren't held up by a mass expiry.
+func expireDevices(candidates map[deviceKey]time.Time) {
+	var archive archiver
+	defer archive.close()
+
+	for {
+		devices.Lock()
+		more := expireBatch(candidates, &archive)
+		devices.Unlock()
+		archive.write()
+		if !more {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// expireBatch removes at most -cleanup-batch of the candidates, forgetting
+// the ones it went through, and reports whether it stopped before the end of
+// the devices. The devices lock must be held.
+func expireBatch(candidates map[deviceKey]time.Time, archive *archiver) bool {
+	kept := devices.d[:0]
+	removed, more := 0, false
+	for i, d := range devices.d {
+		if cleanupBatch > 0 && removed == cleanupBatch {
+			kept = append(kept, devices.d[i:]...)
+			more = true
+			break
+		}
+
+		added, ok := candidates[d.key()]
+		delete(candidates, d.key())
+		if ok && d.Added.Equal(added) && d.expired() {
+			if d.Deleted.IsZero() {
+				log.Println("deleting", logIP(d.InternalAddress), "(timeout)")
+				archive.add(d, "timeout")
+				notify("expired", d)
+				runExpiryHooks(d)
+				expiredTotal.Add(1)
+			} else {
+				log.Println("deleting", logIP(d.InternalAddress), "(tombstone)")
+				archive.add(d, "tombstone")
+			}
+			removed++
+			continue
+		}
+
+		if len(d.PreviousPorts) > 0 {
+			if recent := d.recentPorts(); len(recent) != len(d.PreviousPorts) {
+				d.PreviousPorts = recent
+				changed()
+			}
+		}
+		kept = append(kept, d)
+	}
+
+	if removed > 0 {
+		clear(devices.d[len(kept):])
+		setDevices(kept)
+		reindex()
+		changed()
 	}
+	return more && len(candidates) > 0
 }
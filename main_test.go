@@ -2,13 +2,30 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestRegister(t *testing.T) {
+	// The network is shared with the next tests.
+	forget("80.2.3.41")
 	// NOTE: I allow space in the address, so scripts are easier
 	body := bytes.NewBufferString("{\"name\":\"Testdevice\",\"address\":\"192.168.100.151 \"}")
 	req, err := http.NewRequest("POST", "/api/register", body)
@@ -33,7 +50,7 @@ func TestRegister(t *testing.T) {
 	}
 
 	// Check the response body is what we expect.
-	expected := "Successfully added, visit https://nupnp.com for more.\n"
+	expected := "Successfully added, visit https://localhost:8180 for more.\n"
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -60,7 +77,7 @@ func TestRegisterWithPort(t *testing.T) {
 	}
 
 	// Check the response body is what we expect.
-	expected := "Successfully added, visit https://nupnp.com for more.\n"
+	expected := "Successfully added, visit https://localhost:8180 for more.\n"
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
@@ -193,3 +210,1948 @@ func TestIPv6URL(t *testing.T) {
 			status, rr.Body)
 	}
 }
+
+// resetDevices forgets the devices registered before the test: refreshing
+// them needs their token, lost when the test runs again, e.g. with -count.
+func resetDevices() {
+	devices.Lock()
+	defer devices.Unlock()
+	setDevices([]Device{})
+	reindex()
+}
+
+// forget drops what the service remembers of the networks from a previous
+// run of the test, e.g. with -count: their devices, which can't be refreshed
+// without the tokens lost in between, their registration rate and ports.
+func forget(eas ...string) {
+	devices.Lock()
+	setDevices(slices.DeleteFunc(devices.d, func(d Device) bool { return slices.Contains(eas, d.ExternalAddress) }))
+	reindex()
+	devices.Unlock()
+
+	registerLimiter.Lock()
+	hostPorts.Lock()
+	for _, ea := range eas {
+		delete(registerLimiter.clients, ea)
+		for k := range hostPorts.hosts {
+			if k.ea == ea {
+				delete(hostPorts.hosts, k)
+			}
+		}
+	}
+	hostPorts.Unlock()
+	registerLimiter.Unlock()
+}
+
+// post sends body as JSON to the handler as if it came from remoteAddr.
+func post(t *testing.T, h http.HandlerFunc, remoteAddr, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return postToken(t, h, remoteAddr, "", body)
+}
+
+// postToken is post with the token of a device, to refresh it.
+func postToken(t *testing.T, h http.HandlerFunc, remoteAddr, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Device-Token", token)
+	}
+	req.RemoteAddr = remoteAddr
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// get requests target from the handler as if it came from remoteAddr.
+func get(t *testing.T, h http.HandlerFunc, remoteAddr, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = remoteAddr
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTags(t *testing.T) {
+	forget("80.2.3.43")
+	for _, b := range []string{
+		`{"name":"Primary","address":"192.168.100.160","tags":["role=primary","floor=1"]}`,
+		`{"name":"Secondary","address":"192.168.100.161","tags":["role=secondary","floor=1"]}`,
+	} {
+		rr := post(t, RegisterDevice, "80.2.3.43:321", b)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v - %v", status, rr.Body)
+		}
+	}
+
+	rr := get(t, ListDevices, "80.2.3.43:321", "/api/devices?tag=floor=1&tag=role=primary")
+	if !strings.HasPrefix(rr.Body.String(), `[{"internaladdress":"192.168.100.160","name":"Primary"`) || strings.Contains(rr.Body.String(), "Secondary") {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+}
+
+func TestTooManyTags(t *testing.T) {
+	tags := strings.Repeat(`"t",`, maxTags) + `"t"`
+	rr := post(t, RegisterDevice, "80.2.3.43:321", `{"name":"Testdevice","address":"192.168.100.162","tags":[`+tags+`]}`)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", status, rr.Body)
+	}
+}
+
+func TestUnregisterTombstone(t *testing.T) {
+	defer func(w time.Duration) { tombstoneWindow = w }(tombstoneWindow)
+	tombstoneWindow = time.Minute
+
+	rr := post(t, RegisterDevice, "80.2.3.44:321", `{"name":"Testdevice","address":"192.168.100.170"}`)
+	token := rr.Header().Get("X-Device-Token")
+	if token == "" {
+		t.Fatal("handler returned no device token")
+	}
+
+	for _, tc := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusForbidden},
+		{"invalid", http.StatusForbidden},
+		{token, http.StatusOK},
+	} {
+		req, err := http.NewRequest("POST", "/api/unregister", bytes.NewBufferString(`{"address":"192.168.100.170"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("X-Device-Token", tc.token)
+		req.RemoteAddr = "80.2.3.44:321"
+
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(UnregisterDevice).ServeHTTP(rr, req)
+		if status := rr.Code; status != tc.status {
+			t.Fatalf("handler returned wrong status code: got %v want %v - %v", status, tc.status, rr.Body)
+		}
+	}
+
+	for q, expected := range map[string]string{
+		"":                      "[]\n",
+		"?include_deleted=true": `"deleted":true`,
+	} {
+		rr := get(t, ListDevices, "80.2.3.44:321", "/api/devices"+q)
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("%q: handler returned unexpected body: got %v want %v", q, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestTrailingData(t *testing.T) {
+	rr := post(t, RegisterDevice, "80.2.3.41:321", `{"name":"Testdevice","address":"192.168.100.153"}{"evil":true}`)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", status, rr.Body)
+	}
+}
+
+func TestCleanupWakeOnFirstDevice(t *testing.T) {
+	devices.Lock()
+	saved := devices.d
+	setDevices([]Device{})
+	devices.Unlock()
+	defer func(l time.Duration) {
+		devices.Lock()
+		setDevices(saved)
+		devices.Unlock()
+		lifetime = l
+	}(lifetime)
+	lifetime = time.Hour
+
+	// Drain any pending wake up from previous registrations.
+	select {
+	case <-cleanupWake:
+	default:
+	}
+
+	post(t, RegisterDevice, "80.2.3.45:321", `{"name":"Testdevice","address":"192.168.100.180"}`)
+
+	select {
+	case <-cleanupWake:
+	default:
+		t.Fatal("cleanup was not woken up by the first device")
+	}
+
+	if wait := nextCleanup(); wait > lifetime+time.Second || wait < lifetime {
+		t.Errorf("next cleanup scheduled in %v, expected about %v", wait, lifetime)
+	}
+}
+
+func TestCleanupWakeOnSoonerExpiry(t *testing.T) {
+	defer func(l time.Duration, d int64) {
+		lifetime = l
+		cleanupDeadline.Store(d)
+	}(lifetime, cleanupDeadline.Load())
+	lifetime = time.Hour
+	// As scheduled by the cleanup with a single device.
+	cleanupDeadline.Store(time.Now().Add(lifetime).UnixNano())
+	drain := func() bool {
+		select {
+		case <-cleanupWake:
+			return true
+		default:
+			return false
+		}
+	}
+	drain()
+
+	post(t, RegisterDevice, "80.2.3.113:321", `{"name":"Long","address":"192.168.100.116"}`)
+	if drain() {
+		t.Error("cleanup was woken up by a device expiring after its next scan")
+	}
+
+	soon := time.Now().Add(2 * time.Minute).UTC().Format(time.RFC3339)
+	post(t, RegisterDevice, "80.2.3.113:321", `{"name":"Short","address":"192.168.100.117","expires_at":"`+soon+`"}`)
+	if !drain() {
+		t.Error("cleanup was not woken up by a device expiring before its next scan")
+	}
+
+	// Until the cleanup runs, the expired device is not listed.
+	devices.Lock()
+	if i, ok := findDevice("192.168.100.117", owner{"80.2.3.113", "", ""}); ok {
+		devices.d[i].ExpiresAt = time.Now().Add(-time.Minute)
+	}
+	devices.Unlock()
+	rr := get(t, ListDevices, "80.2.3.113:321", "/api/devices")
+	if body := rr.Body.String(); !strings.Contains(body, "192.168.100.116") || strings.Contains(body, "192.168.100.117") {
+		t.Errorf("expected only the live device, got %v", body)
+	}
+}
+
+func TestRegisterWithPorts(t *testing.T) {
+	forget("80.2.3.46")
+	rr := post(t, RegisterDevice, "80.2.3.46:321", `{"name":"Gateway","address":"192.168.100.200","port":[8080,8443]}`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", status, rr.Body)
+	}
+
+	rr = get(t, ListDevices, "80.2.3.46:321", "/api/devices")
+	if !strings.HasPrefix(rr.Body.String(), `[{"internaladdress":"192.168.100.200","port":8080,"name":"Gateway"`) || !strings.Contains(rr.Body.String(), `"ports":[8080,8443]`) {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	for _, b := range []string{
+		`{"name":"Gateway","address":"192.168.100.201","port":70000}`,
+		`{"name":"Gateway","address":"192.168.100.201","port":[8080,0]}`,
+		`{"name":"Gateway","address":"192.168.100.201","port":"8080"}`,
+	} {
+		rr := post(t, RegisterDevice, "80.2.3.46:321", b)
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v - %v", b, status, rr.Body)
+		}
+	}
+}
+
+func TestListAddresses(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.47:321", `{"name":"Testdevice","address":"192.168.100.210"}`)
+	post(t, RegisterDevice, "80.2.3.47:321", `{"name":"Testdevice","address":"fd00::210","port":8080}`)
+
+	expected := "192.168.100.210\n[fd00::210]:8080\n"
+	if rr := get(t, ListDevices, "80.2.3.47:321", "/api/devices?fields=address"); rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+	}
+
+	req, err := http.NewRequest("GET", "/api/devices", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/plain")
+	req.RemoteAddr = "80.2.3.47:321"
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ListDevices).ServeHTTP(rr, req)
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", rr.Body.String(), expected)
+	}
+}
+
+func TestScopeToken(t *testing.T) {
+	defer func(b bool) { requireScopeToken = b }(requireScopeToken)
+	requireScopeToken = true
+
+	if rr := post(t, RegisterDevice, "100.64.0.1:321", `{"name":"Testdevice","address":"192.168.1.10"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+	if rr := get(t, ListDevices, "100.64.0.1:321", "/api/devices"); rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+
+	post(t, RegisterDevice, "100.64.0.1:321", `{"name":"Alice","address":"192.168.1.10","scope":"alice"}`)
+	post(t, RegisterDevice, "100.64.0.1:321", `{"name":"Bob","address":"192.168.1.10","scope":"bob"}`)
+
+	rr := get(t, ListDevices, "100.64.0.1:321", "/api/devices?scope=alice")
+	if !strings.Contains(rr.Body.String(), `"name":"Alice"`) || strings.Contains(rr.Body.String(), "Bob") {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+}
+
+func TestContentType(t *testing.T) {
+	for ct, status := range map[string]int{
+		"application/json; charset=utf-8": http.StatusOK,
+		"Application/JSON":                http.StatusOK,
+		"text/json":                       http.StatusOK,
+		"text/plain":                      http.StatusBadRequest,
+		"":                                http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("POST", "/api/register", bytes.NewBufferString(`{"name":"Testdevice","address":"192.168.100.151"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", ct)
+		// A network of its own, for each content type to register a device.
+		forget("80.2.4." + strconv.Itoa(len(ct)))
+		req.RemoteAddr = "80.2.4." + strconv.Itoa(len(ct)) + ":321"
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(RegisterDevice).ServeHTTP(rr, req)
+		if rr.Code != status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", ct, rr.Code, status)
+		}
+	}
+}
+
+func TestPublicURL(t *testing.T) {
+	defer func(u, h string) { publicURL, allowedHosts = u, h }(publicURL, allowedHosts)
+
+	for _, tc := range []struct {
+		publicURL, allowedHosts, host, expected string
+	}{
+		{"", "", "", "https://localhost:8180"},
+		{"", "example.org", "example.org", "https://example.org"},
+		{"", "other.org,example.org", "EXAMPLE.org:8443", "https://EXAMPLE.org:8443"},
+		{"", "", "evil.example", "https://localhost:8180"},
+		{"", "example.org", "evil.example", "https://localhost:8180"},
+		{"https://discover.example.org", "", "example.org", "https://discover.example.org"},
+	} {
+		publicURL, allowedHosts = tc.publicURL, tc.allowedHosts
+
+		req, err := http.NewRequest("POST", "/api/register", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tc.host
+
+		if u := publicBaseURL(req); u != tc.expected {
+			t.Errorf("got %v want %v", u, tc.expected)
+		}
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	defer func(l, m time.Duration) { lifetime, maxLifetime = l, m }(lifetime, maxLifetime)
+	lifetime, maxLifetime = time.Hour, 2*time.Hour
+
+	now := time.Now()
+	for _, tc := range []struct {
+		d        Device
+		expected time.Time
+	}{
+		{Device{Added: now, LastSeen: now}, now.Add(lifetime)},
+		{Device{Added: now.Add(-90 * time.Minute), LastSeen: now}, now.Add(30 * time.Minute)},
+	} {
+		if e := tc.d.expiresAt(); !e.Equal(tc.expected) {
+			t.Errorf("device expires at %v, expected %v", e, tc.expected)
+		}
+	}
+}
+
+func TestDeviceTTL(t *testing.T) {
+	defer func(l time.Duration) { lifetime = l }(lifetime)
+	lifetime = time.Hour
+
+	post(t, RegisterDevice, "80.2.3.48:321", `{"name":"Testdevice","address":"192.168.100.240"}`)
+
+	rr := get(t, DeviceTTL, "80.2.3.48:321", "/api/device/ttl?address=192.168.100.240")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+	if b := rr.Body.String(); b != "{\"expires_in_seconds\":3599}\n" && b != "{\"expires_in_seconds\":3600}\n" {
+		t.Errorf("handler returned unexpected body: got %v", b)
+	}
+
+	// Devices are only visible from their own network.
+	if rr := get(t, DeviceTTL, "80.2.3.49:321", "/api/device/ttl?address=192.168.100.240"); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestRegisterTakeover(t *testing.T) {
+	forget("80.2.3.112")
+	rr := post(t, RegisterDevice, "80.2.3.112:321", `{"name":"Owned","address":"192.168.100.115"}`)
+	token := rr.Header().Get("X-Device-Token")
+	name := func() string {
+		devices.RLock()
+		defer devices.RUnlock()
+		i, _ := findDevice("192.168.100.115", owner{ea: "80.2.3.112"})
+		return devices.d[i].Name
+	}
+
+	// Another host of the network can't update, or expire, the device.
+	soon := time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+	for _, body := range []string{
+		`{"name":"Taken","address":"192.168.100.115"}`,
+		`{"name":"Owned","address":"192.168.100.115","expires_at":"` + soon + `"}`,
+	} {
+		if rr := post(t, RegisterDevice, "80.2.3.112:321", body); rr.Code != http.StatusForbidden {
+			t.Errorf("expected 403 without the token, got %d - %v", rr.Code, rr.Body)
+		}
+	}
+	if rr := post(t, RegisterDevices, "80.2.3.112:321", `[{"name":"Taken","address":"192.168.100.115"}]`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a bulk registration without the token, got %d - %v", rr.Code, rr.Body)
+	}
+	if rr := postToken(t, Batch, "80.2.3.112:321", "wrong", `[{"op":"heartbeat","params":{"address":"192.168.100.115"}}]`); !strings.Contains(rr.Body.String(), `"status":403`) {
+		t.Errorf("expected a 403 heartbeat with a wrong token, got %v", rr.Body)
+	}
+	if got := name(); got != "Owned" {
+		t.Errorf("expected the device to be left alone, got %q", got)
+	}
+
+	if rr := postToken(t, RegisterDevice, "80.2.3.112:321", token, `{"name":"Renamed","address":"192.168.100.115"}`); rr.Code != http.StatusOK || name() != "Renamed" {
+		t.Errorf("expected the token to allow the update, got %d - %v", rr.Code, rr.Body)
+	}
+
+	// Once unregistered, the address can be registered again, with a new token.
+	if rr := postToken(t, UnregisterDevice, "80.2.3.112:321", token, `{"address":"192.168.100.115"}`); rr.Code != http.StatusOK {
+		t.Fatalf("unable to unregister: %d - %v", rr.Code, rr.Body)
+	}
+	rr = post(t, RegisterDevice, "80.2.3.112:321", `{"name":"New","address":"192.168.100.115"}`)
+	if issued := rr.Header().Get("X-Device-Token"); rr.Code != http.StatusOK || issued == "" || issued == token {
+		t.Errorf("expected a new token after the unregistration, got %d %q - %v", rr.Code, issued, rr.Body)
+	}
+}
+
+func TestNoRefreshOnMetadataOnly(t *testing.T) {
+	forget("80.2.3.52")
+	defer func(b bool) { noRefreshOnMetadata = b }(noRefreshOnMetadata)
+	noRefreshOnMetadata = true
+
+	token := post(t, RegisterDevice, "80.2.3.52:321", `{"name":"Before","address":"192.168.100.241"}`).Header().Get("X-Device-Token")
+
+	devices.Lock()
+	i, _ := findDevice("192.168.100.241", owner{ea: "80.2.3.52"})
+	past := time.Now().Add(-time.Hour)
+	devices.d[i].LastSeen = past
+	devices.Unlock()
+
+	lastSeen := func() time.Time {
+		devices.RLock()
+		defer devices.RUnlock()
+		return devices.d[i].LastSeen
+	}
+
+	if rr := postToken(t, RegisterDevice, "80.2.3.52:321", token, `{"name":"After","address":"192.168.100.241"}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+	if !lastSeen().Equal(past) {
+		t.Error("a metadata change refreshed the device")
+	}
+
+	postToken(t, RegisterDevice, "80.2.3.52:321", token, `{"name":"After","address":"192.168.100.241"}`)
+	if lastSeen().Equal(past) {
+		t.Error("an identical registration didn't refresh the device")
+	}
+}
+
+func TestDeviceID(t *testing.T) {
+	d := Device{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.151", Port: 80}
+	if d.ID() != "91c5abf533fc9c60" {
+		t.Errorf("unexpected id %v", d.ID())
+	}
+
+	d.Name = "Renamed"
+	d.Added = time.Now()
+	if d.ID() != "91c5abf533fc9c60" {
+		t.Errorf("id changed with the device metadata: %v", d.ID())
+	}
+
+	d.Port = 8080
+	if d.ID() == "91c5abf533fc9c60" {
+		t.Error("id didn't change with the device port")
+	}
+}
+
+func TestIPv6ScopePrefix(t *testing.T) {
+	defer func(p int) { ipv6ScopePrefix = p }(ipv6ScopePrefix)
+	ipv6ScopePrefix = 64
+
+	post(t, RegisterDevice, "[2001:db8:1:2::a]:321", `{"name":"Testdevice","address":"fd00::243"}`)
+
+	if rr := get(t, ListDevices, "[2001:db8:1:2::b]:321", "/api/devices"); !strings.Contains(rr.Body.String(), "fd00::243") {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+	if rr := get(t, ListDevices, "[2001:db8:1:3::a]:321", "/api/devices"); rr.Body.String() != "[]\n" {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	ipv6ScopePrefix = 0
+	if rr := get(t, ListDevices, "[2001:db8:1:2::b]:321", "/api/devices"); rr.Body.String() != "[]\n" {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+}
+
+func TestListHead(t *testing.T) {
+	handler := allowMethods(ListDevices, http.MethodGet, http.MethodHead)
+
+	got := get(t, handler, "80.2.3.41:321", "/api/devices")
+
+	req, err := http.NewRequest("HEAD", "/api/devices", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "80.2.3.41:321"
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("handler returned unexpected response: got %v - %v", rr.Code, rr.Body)
+	}
+	for _, h := range []string{"ETag", "X-Total-Count", "Content-Length", "Content-Type"} {
+		if rr.Header().Get(h) == "" || rr.Header().Get(h) != got.Header().Get(h) {
+			t.Errorf("%s: got %q want %q", h, rr.Header().Get(h), got.Header().Get(h))
+		}
+	}
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		req, err := http.NewRequest(method, "/api/devices", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s: handler returned unexpected response: got %v, Allow: %q", method, rr.Code, rr.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	for _, tc := range []struct {
+		method, path, allow string
+	}{
+		{"GET", "/api/register", "POST"},
+		{"PUT", "/api/register", "POST"},
+		{"GET", "/api/unregister", "POST"},
+		{"POST", "/api/devices", "GET, HEAD"},
+		{"DELETE", "/api/devices", "GET, HEAD"},
+		{"POST", "/api/device/ttl", "GET, HEAD"},
+		{"POST", "/api/admin/ips", "GET, HEAD"},
+		{"DELETE", "/api/admin/devices", "GET, HEAD"},
+	} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.path, nil))
+
+		if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s: handler returned unexpected response: got %v, Allow: %q", tc.method, tc.path, rr.Code, rr.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestExpiryJitter(t *testing.T) {
+	defer func(j time.Duration) { expiryJitter = j }(expiryJitter)
+	expiryJitter = time.Minute
+
+	now := time.Now()
+	a := Device{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.31", Added: now, LastSeen: now}
+	b := Device{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.32", Added: now, LastSeen: now}
+
+	if a.expiresAt() != a.expiresAt() {
+		t.Error("expected the jitter of a device not to change")
+	}
+	if a.expiresAt() == b.expiresAt() {
+		t.Error("expected devices registered together to expire at different times")
+	}
+	for _, d := range []Device{a, b} {
+		if j := d.jitter(); j < 0 || j >= expiryJitter {
+			t.Errorf("jitter %v out of [0, %v)", j, expiryJitter)
+		}
+	}
+}
+
+func TestMaxExternalIPs(t *testing.T) {
+	forget("80.2.3.66", "80.2.3.67")
+	defer func(n int) { maxExternalIPs = n }(maxExternalIPs)
+
+	devices.RLock()
+	n, _ := externalAddresses("")
+	devices.RUnlock()
+	maxExternalIPs = n + 1
+
+	if rr := post(t, RegisterDevice, "80.2.3.66:321", `{"name":"Device","address":"192.168.100.33"}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+	if rr := post(t, RegisterDevice, "80.2.3.67:321", `{"name":"Device","address":"192.168.100.33"}`); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a new external address to be rejected, got %v - %v", rr.Code, rr.Body)
+	}
+	if rr := post(t, RegisterDevice, "80.2.3.66:321", `{"name":"Device","address":"192.168.100.34"}`); rr.Code != http.StatusOK {
+		t.Errorf("expected a known external address to keep registering, got %v - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestExternalAddressesSkipsTombstones(t *testing.T) {
+	defer func(w time.Duration) { tombstoneWindow = w }(tombstoneWindow)
+	tombstoneWindow = time.Minute
+
+	token := post(t, RegisterDevice, "80.2.3.116:321", `{"name":"Gone","address":"192.168.100.124"}`).Header().Get("X-Device-Token")
+	devices.RLock()
+	n, known := externalAddresses("80.2.3.116")
+	devices.RUnlock()
+	if !known {
+		t.Fatal("expected the external address of a live device to be known")
+	}
+
+	if rr := postToken(t, UnregisterDevice, "80.2.3.116:321", token, `{"address":"192.168.100.124"}`); rr.Code != http.StatusOK {
+		t.Fatalf("got %v - %v", rr.Code, rr.Body)
+	}
+	devices.Lock()
+	defer devices.Unlock()
+	// Both with the index and without it.
+	for _, index := range []bool{true, false} {
+		if index {
+			reindex()
+		} else {
+			devices.byEA = nil
+		}
+		if after, known := externalAddresses("80.2.3.116"); known || after != n-1 {
+			t.Errorf("index %v: expected the tombstone not to count, got %d (was %d), known %v", index, after, n, known)
+		}
+	}
+	reindex()
+}
+
+func TestPagination(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		post(t, RegisterDevice, "80.2.3.69:321", fmt.Sprintf(`{"name":"Device %d","address":"192.168.100.%d"}`, i, 40+i))
+	}
+
+	for _, tc := range []struct {
+		query, first, link string
+		count              int
+	}{
+		{"limit=2", "Device 0", `</api/devices?limit=2&offset=2>; rel="next"`, 2},
+		{"limit=2&offset=2", "Device 2", `</api/devices?limit=2&offset=0>; rel="prev", </api/devices?limit=2&offset=4>; rel="next"`, 2},
+		{"limit=2&offset=4", "Device 4", `</api/devices?limit=2&offset=2>; rel="prev"`, 1},
+		{"offset=3", "Device 3", `</api/devices?limit=5&offset=0>; rel="prev"`, 2},
+	} {
+		rr := get(t, ListDevices, "80.2.3.69:321", "/api/devices?"+tc.query)
+		var list []Device
+		if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list) != tc.count || list[0].Name != tc.first {
+			t.Errorf("%s: unexpected page %v: %v", tc.query, rr.Body.String(), err)
+		}
+		if link := rr.Header().Get("Link"); link != tc.link {
+			t.Errorf("%s: got Link %q want %q", tc.query, link, tc.link)
+		}
+		if total := rr.Header().Get("X-Total-Count"); total != "5" {
+			t.Errorf("%s: got X-Total-Count %v want 5", tc.query, total)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "offset=-1"} {
+		if rr := get(t, ListDevices, "80.2.3.69:321", "/api/devices?"+query); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v", query, rr.Code)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+
+	for _, rt := range apiRoutes {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("OPTIONS", rt.path, nil))
+
+		allow := strings.Join(rt.methods, ", ") + ", OPTIONS"
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Allow") != allow {
+			t.Errorf("OPTIONS %s: handler returned unexpected response: got %v, Allow: %q want %q", rt.path, rr.Code, rr.Header().Get("Allow"), allow)
+		}
+	}
+}
+
+func TestStale(t *testing.T) {
+	defer func(l, w time.Duration) { lifetime, staleWindow = l, w }(lifetime, staleWindow)
+	lifetime, staleWindow = time.Hour, 10*time.Minute
+
+	now := time.Now()
+	for _, tc := range []struct {
+		lastSeen time.Time
+		stale    bool
+	}{
+		{now, false},
+		{now.Add(-55 * time.Minute), true},
+	} {
+		b, err := json.Marshal(Device{Added: tc.lastSeen, LastSeen: tc.lastSeen})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf(`"stale":%v`, tc.stale); !strings.Contains(string(b), expected) {
+			t.Errorf("got %s, expected %s", b, expected)
+		}
+	}
+}
+
+func TestListPretty(t *testing.T) {
+	rr := get(t, ListDevices, "80.2.3.41:321", "/api/devices?pretty=true")
+	if !strings.HasPrefix(rr.Body.String(), "[\n  {\n    \"internaladdress\": \"192.168.100.151\",") {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+}
+
+func TestOfflineGrace(t *testing.T) {
+	defer func(l, g time.Duration) { lifetime, offlineGrace = l, g }(lifetime, offlineGrace)
+	lifetime, offlineGrace = time.Hour, time.Hour
+
+	now := time.Now()
+	for _, tc := range []struct {
+		d     Device
+		state string
+	}{
+		{Device{Added: now, LastSeen: now}, "online"},
+		{Device{Added: now.Add(-90 * time.Minute), LastSeen: now.Add(-90 * time.Minute)}, "offline"},
+		{Device{Added: now, LastSeen: now, Deleted: now}, "deleted"},
+	} {
+		if s := tc.d.state(); s != tc.state {
+			t.Errorf("got %v, expected %v", s, tc.state)
+		}
+	}
+
+	d := Device{Added: now, LastSeen: now}
+	if e := d.expiresAt(); !e.Equal(now.Add(lifetime + offlineGrace)) {
+		t.Errorf("device expires at %v, expected after the grace period", e)
+	}
+}
+
+func TestLocation(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.55:321", `{"name":"Sensor","address":"192.168.100.245","location":" Floor 2 - Room 204\n"}`)
+	post(t, RegisterDevice, "80.2.3.55:321", `{"name":"Sensor","address":"192.168.100.246","location":"Floor 3 - Room 301"}`)
+
+	rr := get(t, ListDevices, "80.2.3.55:321", "/api/devices?location="+url.QueryEscape("Floor 2 - Room 204"))
+	if !strings.Contains(rr.Body.String(), `"location":"Floor 2 - Room 204"`) || strings.Contains(rr.Body.String(), "Floor 3") {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	rr = post(t, RegisterDevice, "80.2.3.55:321", `{"name":"Sensor","address":"192.168.100.247","location":"`+strings.Repeat("x", maxLocationLength+1)+`"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestSchemeEffectivePort(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.56:321", `{"name":"Web","address":"192.168.100.248","scheme":"HTTPS"}`)
+	post(t, RegisterDevice, "80.2.3.56:321", `{"name":"Web","address":"192.168.100.249","scheme":"http","port":8080}`)
+
+	rr := get(t, ListDevices, "80.2.3.56:321", "/api/devices")
+	var list []struct {
+		InternalAddress string `json:"internaladdress"`
+		Port            int    `json:"port"`
+		Scheme          string `json:"scheme"`
+		EffectivePort   int    `json:"effective_port"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list) != 2 {
+		t.Fatalf("unexpected list %v: %v", rr.Body.String(), err)
+	}
+	if d := list[0]; d.Scheme != "https" || d.Port != 0 || d.EffectivePort != 443 {
+		t.Errorf("expected the https default port, got %+v", d)
+	}
+	if d := list[1]; d.Port != 8080 || d.EffectivePort != 8080 {
+		t.Errorf("expected the registered port, got %+v", d)
+	}
+	if strings.Contains(rr.Body.String(), `"port":0`) {
+		t.Errorf("expected the zero port to be omitted, got %v", rr.Body.String())
+	}
+
+	rr = post(t, RegisterDevice, "80.2.3.56:321", `{"name":"Web","address":"192.168.100.250","scheme":"not a scheme"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestRequirePrivateInternal(t *testing.T) {
+	forget("80.2.3.57")
+	defer func(v bool) { requirePrivate = v }(requirePrivate)
+	requirePrivate = true
+
+	for _, tc := range []struct {
+		address string
+		status  int
+	}{
+		{"192.168.100.251", http.StatusOK},
+		{"10.0.0.8", http.StatusOK},
+		{"fd00::8", http.StatusOK},
+		{"8.8.8.8", http.StatusBadRequest},
+		{"2001:db8::8", http.StatusBadRequest},
+	} {
+		rr := post(t, RegisterDevice, "80.2.3.57:321", `{"name":"Device","address":"`+tc.address+`"}`)
+		if rr.Code != tc.status {
+			t.Errorf("%v: handler returned wrong status code: got %v want %v", tc.address, rr.Code, tc.status)
+		}
+	}
+}
+
+func TestUnreachableAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		address, message string
+	}{
+		{"127.0.0.2", "Loopback"},
+		{"::1", "Loopback"},
+		{"0.0.0.0", "unspecified"},
+		{"::", "unspecified"},
+		{"169.254.1.2", "link-local"},
+		{"fe80::1", "link-local"},
+		{"224.0.0.251", "multicast"},
+		{"ff02::fb", "multicast"},
+	} {
+		rr := post(t, RegisterDevice, "80.2.3.58:321", `{"name":"Device","address":"`+tc.address+`"}`)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tc.message) {
+			t.Errorf("%v: got %v - %v, expected a %s error", tc.address, rr.Code, rr.Body, tc.message)
+		}
+	}
+}
+
+func TestGetRegister(t *testing.T) {
+	forget("80.2.3.59")
+	defer func(v bool) { allowGetRegister = v }(allowGetRegister)
+
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	rr := get(t, mux.ServeHTTP, "80.2.3.59:321", "/api/register?name=Sensor&address=192.168.100.14")
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET registrations to be disabled, got %v", rr.Code)
+	}
+
+	allowGetRegister = true
+	mux = http.NewServeMux()
+	registerRoutes(mux)
+	rr = get(t, mux.ServeHTTP, "80.2.3.59:321", "/api/register?name=Sensor&address=192.168.100.14&port=8080,8443&tag=a&tag=b")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Device-Token") == "" {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+
+	rr = get(t, ListDevices, "80.2.3.59:321", "/api/devices")
+	if !strings.HasPrefix(rr.Body.String(), `[{"internaladdress":"192.168.100.14","port":8080,"name":"Sensor"`) ||
+		!strings.Contains(rr.Body.String(), `"tags":["a","b"],"ports":[8080,8443]`) {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	for _, query := range []string{"name=Sensor&address=127.0.0.1", "name=Sensor&address=192.168.100.15&port=http"} {
+		rr = get(t, mux.ServeHTTP, "80.2.3.59:321", "/api/register?"+query)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v - %v", query, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestSanitizeInvisible(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"Living\u200broom", "Livingroom"},
+		{"\ufeffCamera\u2060", "Camera"},
+		{"file\u202egnp.exe", "filegnp.exe"},
+		{"\u2066Printer\u2069", "Printer"},
+		{"Caf\u00e9", "Caf\u00e9"},
+	} {
+		if out := sanitizeText(tc.in); out != tc.out {
+			t.Errorf("sanitizeText(%q) = %q, want %q", tc.in, out, tc.out)
+		}
+	}
+}
+
+func TestNormalizedName(t *testing.T) {
+	forget("80.2.3.119")
+	post(t, RegisterDevice, "80.2.3.119:321", `{"name":"Caf\u00e9","address":"192.168.100.125"}`)
+
+	// The decomposed form of the same name is the same name.
+	if rr := post(t, RegisterDevice, "80.2.3.119:321", `{"name":"Cafe\u0301","address":"192.168.100.126","only_if_absent":true}`); rr.Code != http.StatusConflict {
+		t.Errorf("expected the decomposed name to be claimed, got %v - %v", rr.Code, rr.Body)
+	}
+	if rr := post(t, RegisterDevice, "80.2.3.119:321", `{"name":"Bare\u0301","address":"192.168.100.126"}`); rr.Code != http.StatusOK {
+		t.Fatalf("got %v - %v", rr.Code, rr.Body)
+	}
+	var ds []Device
+	if err := json.Unmarshal(get(t, ListDevices, "80.2.3.119:321", "/api/devices").Body.Bytes(), &ds); err != nil || len(ds) != 2 || ds[1].Name != "Bar\u00e9" {
+		t.Errorf("expected the name to be stored in NFC, got %v - %v", ds, err)
+	}
+}
+
+func TestFavicon(t *testing.T) {
+	defer func(path string) { faviconPath = path }(faviconPath)
+
+	rr := get(t, Favicon, "80.2.3.41:321", "/favicon.ico")
+	if rr.Code != http.StatusOK || rr.Body.Len() == 0 || rr.Header().Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("expected a cached favicon, got %v - %v", rr.Code, rr.Header())
+	}
+
+	faviconPath = ""
+	rr = get(t, Favicon, "80.2.3.41:321", "/favicon.ico")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected no favicon, got %v", rr.Code)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.70:321", `{"name":"Camera","address":"192.168.100.50","metadata":{"model":"X1","fw":"2.1"}}`)
+
+	rr := get(t, ListDevices, "80.2.3.70:321", "/api/devices")
+	if !strings.Contains(rr.Body.String(), `"metadata":{"fw":"2.1","model":"X1"}`) {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	rr = post(t, RegisterDevice, "80.2.3.70:321", `{"name":"Camera","address":"192.168.100.51","metadata":{"blob":"`+strings.Repeat("x", maxMetadataBytes)+`"}}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestDeviceExists(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.71:321", `{"name":"Device","address":"192.168.100.52"}`)
+
+	for _, tc := range []struct {
+		remote, address string
+		status          int
+	}{
+		{"80.2.3.71:321", "192.168.100.52", http.StatusNoContent},
+		{"80.2.3.71:321", "192.168.100.53", http.StatusNotFound},
+		{"80.2.3.72:321", "192.168.100.52", http.StatusNotFound},
+	} {
+		rr := get(t, DeviceExists, tc.remote, "/api/device/exists?address="+tc.address)
+		if rr.Code != tc.status || rr.Body.Len() != 0 {
+			t.Errorf("%s from %s: got %v - %q want %v without body", tc.address, tc.remote, rr.Code, rr.Body, tc.status)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.Protocols = h2cProtocols()
+	srv.Start()
+	defer srv.Close()
+
+	for _, h2 := range []bool{false, true} {
+		var p http.Protocols
+		p.SetHTTP1(!h2)
+		p.SetUnencryptedHTTP2(h2)
+		client := &http.Client{Transport: &http.Transport{Protocols: &p}}
+
+		req, err := http.NewRequest("GET", srv.URL+"/api/devices", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Real-IP", "80.2.3.41")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := map[bool]int{false: 1, true: 2}[h2]; resp.ProtoMajor != want || resp.StatusCode != http.StatusOK {
+			t.Errorf("got %v over %s, want 200 over HTTP/%d", resp.StatusCode, resp.Proto, want)
+		}
+	}
+}
+
+func TestExtendDevice(t *testing.T) {
+	forget("80.2.3.74")
+	defer func(l, m time.Duration) { lifetime, maxLifetime = l, m }(lifetime, maxLifetime)
+	lifetime, maxLifetime = time.Hour, 0
+
+	rr := post(t, RegisterDevice, "80.2.3.74:321", `{"name":"Device","address":"192.168.100.64"}`)
+	token := rr.Header().Get("X-Device-Token")
+
+	extend := func(token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/api/device/extend", bytes.NewBufferString(`{"address":"192.168.100.64","seconds":600}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("X-Device-Token", token)
+		req.RemoteAddr = "80.2.3.74:321"
+
+		rr := httptest.NewRecorder()
+		ExtendDevice(rr, req)
+		return rr
+	}
+
+	if rr := extend("invalid"); rr.Code != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+
+	var res struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	rr = extend(token)
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unexpected body %v: %v", rr.Body.String(), err)
+	}
+	if d := time.Until(res.ExpiresAt); d < lifetime+9*time.Minute || d > lifetime+10*time.Minute {
+		t.Errorf("expected the expiry to be pushed back by 10 minutes, expires in %v", d)
+	}
+
+	// The extension doesn't go past the max lifetime.
+	maxLifetime = lifetime + time.Minute
+	rr = extend(token)
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatalf("unexpected body %v: %v", rr.Body.String(), err)
+	}
+	if d := time.Until(res.ExpiresAt); d > maxLifetime {
+		t.Errorf("expected the expiry to be bounded by the max lifetime, expires in %v", d)
+	}
+}
+
+// brokenWriter fails writes like a connection closed by the client.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write([]byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+func TestListBrokenPipe(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.75:321", `{"name":"Device","address":"192.168.100.65"}`)
+
+	req := httptest.NewRequest("GET", "/api/devices", nil)
+	req.RemoteAddr = "80.2.3.75:321"
+	w := brokenWriter{httptest.NewRecorder()}
+	ListDevices(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v", w.Code)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	defer func(v int) { maxSchemaVersion = v }(maxSchemaVersion)
+	maxSchemaVersion = 2
+
+	post(t, RegisterDevice, "80.2.3.76:321", `{"name":"Old","address":"192.168.100.66"}`)
+	post(t, RegisterDevice, "80.2.3.76:321", `{"name":"New","address":"192.168.100.67","schema_version":2}`)
+
+	rr := get(t, ListDevices, "80.2.3.76:321", "/api/devices")
+	var list []Device
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil || len(list) != 2 {
+		t.Fatalf("unexpected list %v: %v", rr.Body.String(), err)
+	}
+	if list[0].SchemaVersion != 1 || list[1].SchemaVersion != 2 {
+		t.Errorf("expected schema versions 1 and 2, got %v", rr.Body.String())
+	}
+
+	for _, v := range []string{"3", "-1"} {
+		rr = post(t, RegisterDevice, "80.2.3.76:321", `{"name":"Future","address":"192.168.100.68","schema_version":`+v+`}`)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v - %v", v, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestListConditional(t *testing.T) {
+	defer func(s int) { listCacheSeconds = s }(listCacheSeconds)
+	listCacheSeconds = 30
+
+	post(t, RegisterDevice, "80.2.3.80:321", `{"name":"Device","address":"192.168.100.69"}`)
+
+	rr := get(t, ListDevices, "80.2.3.80:321", "/api/devices")
+	etag, lastModified := rr.Header().Get("ETag"), rr.Header().Get("Last-Modified")
+	if rr.Header().Get("Cache-Control") != "private, max-age=30" || etag == "" || lastModified == "" {
+		t.Fatalf("unexpected caching headers %v", rr.Header())
+	}
+
+	for _, tc := range []struct {
+		header, value string
+		status        int
+	}{
+		{"If-None-Match", etag, http.StatusNotModified},
+		{"If-None-Match", `"other"`, http.StatusOK},
+		{"If-Modified-Since", lastModified, http.StatusNotModified},
+		{"If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/api/devices", nil)
+		req.RemoteAddr = "80.2.3.80:321"
+		req.Header.Set(tc.header, tc.value)
+		rr := httptest.NewRecorder()
+		ListDevices(rr, req)
+		if rr.Code != tc.status {
+			t.Errorf("%s: %s: got %v want %v", tc.header, tc.value, rr.Code, tc.status)
+		}
+		if tc.status == http.StatusNotModified && rr.Body.Len() != 0 {
+			t.Errorf("%s: expected no body, got %q", tc.header, rr.Body)
+		}
+	}
+}
+
+func TestTTLBounds(t *testing.T) {
+	forget("80.2.3.104")
+	defer func(min, max time.Duration, policy string) { minTTL, maxTTL, ttlPolicy = min, max, policy }(minTTL, maxTTL, ttlPolicy)
+	minTTL, maxTTL, ttlPolicy = time.Minute, time.Hour, "clamp"
+	expiresIn := func(d time.Duration) string {
+		return `"expires_at":"` + time.Now().Add(d).UTC().Format(time.RFC3339) + `"`
+	}
+
+	tokens := map[string]string{}
+	extend := func(address string, seconds int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/device/extend", strings.NewReader(fmt.Sprintf(`{"address":%q,"seconds":%d}`, address, seconds)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Device-Token", tokens[address])
+		req.RemoteAddr = "80.2.3.104:321"
+		rr := httptest.NewRecorder()
+		ExtendDevice(rr, req)
+		return rr
+	}
+
+	for _, tc := range []struct {
+		address string
+		ttl     time.Duration
+		want    int64
+	}{
+		{"192.168.100.102", 10 * time.Second, 60},
+		{"192.168.100.103", 24 * time.Hour, 3600},
+	} {
+		rr := post(t, RegisterDevice, "80.2.3.104:321", `{"name":"Bounded","address":"`+tc.address+`",`+expiresIn(tc.ttl)+`}`)
+		tokens[tc.address] = rr.Header().Get("X-Device-Token")
+		got, err := strconv.ParseInt(rr.Header().Get("X-Device-TTL"), 10, 64)
+		if rr.Code != http.StatusOK || err != nil || got < tc.want-2 || got > tc.want {
+			t.Errorf("%v: expected a TTL of %d, got %d %q - %v", tc.ttl, tc.want, rr.Code, rr.Header().Get("X-Device-TTL"), rr.Body)
+		}
+	}
+
+	rr := extend("192.168.100.103", 3600)
+	var extended struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &extended); err != nil || extended.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expected the extension to stay within -max-ttl, got %v - %v", rr.Body, err)
+	}
+
+	ttlPolicy = "reject"
+	if rr := post(t, RegisterDevice, "80.2.3.104:321", `{"name":"Bounded","address":"192.168.100.104",`+expiresIn(24*time.Hour)+`}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 rejecting an out of range TTL, got %d", rr.Code)
+	}
+	if rr := extend("192.168.100.102", 86400); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 rejecting an out of range extension, got %d - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestListIncludeLifetime(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.108:321", `{"name":"Timeline","address":"192.168.100.106"}`)
+
+	rr := get(t, ListDevices, "80.2.3.108:321", "/api/devices")
+	if strings.Contains(rr.Body.String(), `"lifetime"`) {
+		t.Errorf("expected the slim output by default, got %v", rr.Body)
+	}
+
+	rr = get(t, ListDevices, "80.2.3.108:321", "/api/devices?include_lifetime=true")
+	var got []struct {
+		LastSeen time.Time `json:"last_seen"`
+		Lifetime *struct {
+			Added     time.Time `json:"added"`
+			LastSeen  time.Time `json:"last_seen"`
+			Expires   time.Time `json:"expires"`
+			TTL       int64     `json:"ttl_seconds"`
+			Remaining int64     `json:"remaining_seconds"`
+		} `json:"lifetime"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || len(got) != 1 || got[0].Lifetime == nil {
+		t.Fatalf("expected the lifetime of the device, got %v - %v", rr.Body, err)
+	}
+	l := got[0].Lifetime
+	if !l.LastSeen.Equal(got[0].LastSeen) || l.Added.IsZero() || l.Expires.Before(l.LastSeen.Add(lifetime)) {
+		t.Errorf("unexpected timeline %+v", l)
+	}
+	if l.TTL < int64(lifetime/time.Second) || l.Remaining > l.TTL || l.Remaining < l.TTL-2 {
+		t.Errorf("unexpected ttl_seconds %d and remaining_seconds %d", l.TTL, l.Remaining)
+	}
+}
+
+// readCounter counts the bytes read from r.
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestRegisterSpoofedContentLength(t *testing.T) {
+	defer func(max int64) { maxBodyBytes = max }(maxBodyBytes)
+	maxBodyBytes = 1 << 10
+	body := `{"name":"Spoofed","address":"192.168.100.105"}`
+
+	// A small body declared huge is rejected without being read.
+	c := &readCounter{r: strings.NewReader(body)}
+	req := httptest.NewRequest("POST", "/api/register", c)
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "80.2.3.107:321"
+	req.ContentLength = 1 << 40
+	rr := httptest.NewRecorder()
+	RegisterDevice(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge || c.n != 0 {
+		t.Errorf("expected 413 before reading, got %d after reading %d bytes - %v", rr.Code, c.n, rr.Body)
+	}
+
+	// A large body declared small is still limited while reading.
+	large := `{"name":"` + strings.Repeat("a", 2<<10) + `","address":"192.168.100.105"}`
+	req = httptest.NewRequest("POST", "/api/register", strings.NewReader(large))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "80.2.3.107:321"
+	req.ContentLength = int64(len(body))
+	rr = httptest.NewRecorder()
+	RegisterDevice(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a body over the limit, got %d - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestRegisterPath(t *testing.T) {
+	forget("80.2.3.111")
+	rr := post(t, RegisterDevice, "80.2.3.111:321", `{"name":"UPnP","address":"192.168.100.112","port":49152,"path":" /description.xml\u0007 "}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+	rr = get(t, ListDevices, "80.2.3.111:321", "/api/devices")
+	if !strings.Contains(rr.Body.String(), `"path":"/description.xml"`) {
+		t.Errorf("expected the sanitized path in the list, got %v", rr.Body)
+	}
+
+	for _, path := range []string{"description.xml", "/" + strings.Repeat("a", maxPathLength)} {
+		if rr := post(t, RegisterDevice, "80.2.3.111:321", `{"name":"UPnP","address":"192.168.100.113","path":"`+path+`"}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("%.20s: expected 400, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestRegisterExpiresAt(t *testing.T) {
+	forget("80.2.3.81")
+	at := time.Now().Add(10 * time.Minute).UTC().Truncate(time.Second)
+	rr := post(t, RegisterDevice, "80.2.3.81:321", `{"name":"Scheduled","address":"192.168.100.70","expires_at":"`+at.Format(time.RFC3339)+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+
+	rr = get(t, ListDevices, "80.2.3.81:321", "/api/devices")
+	if !strings.Contains(rr.Body.String(), `"expires_at":"`+at.Format(time.RFC3339)+`"`) {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+
+	devices.RLock()
+	i, _ := findDevice("192.168.100.70", owner{ea: "80.2.3.81"})
+	expires := devices.d[i].expiresAt()
+	devices.RUnlock()
+	if !expires.Equal(at) {
+		t.Errorf("expected the device to expire at %v, got %v", at, expires)
+	}
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	rr = post(t, RegisterDevice, "80.2.3.81:321", `{"name":"Late","address":"192.168.100.71","expires_at":"`+past+`"}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+
+	// Devices without it don't list it.
+	rr = get(t, ListDevices, "80.2.3.41:321", "/api/devices")
+	if strings.Contains(rr.Body.String(), `"expires_at"`) {
+		t.Errorf("expected no expires_at, got %v", rr.Body.String())
+	}
+}
+
+func TestExpiredBeforeCleanup(t *testing.T) {
+	forget("80.2.3.121")
+	soon := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	if rr := post(t, RegisterDevice, "80.2.3.121:321", `{"name":"Passed","address":"192.168.100.128","expires_at":"`+soon+`"}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+	// The expires_at passes before cleanup runs.
+	devices.Lock()
+	i, _ := findDevice("192.168.100.128", owner{ea: "80.2.3.121"})
+	devices.d[i].ExpiresAt = time.Now().Add(-time.Second)
+	devices.Unlock()
+
+	if rr := get(t, DeviceExists, "80.2.3.121:321", "/api/device/exists?address=192.168.100.128"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected the expired device not to exist, got %v", rr.Code)
+	}
+	if rr := get(t, DeviceTTL, "80.2.3.121:321", "/api/device/ttl?address=192.168.100.128"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected no TTL for the expired device, got %v", rr.Code)
+	}
+	if rr := get(t, ListDevices, "80.2.3.121:321", "/api/devices"); strings.Contains(rr.Body.String(), "Passed") {
+		t.Errorf("expected the expired device not to be listed, got %v", rr.Body)
+	}
+	if rr := get(t, AdminListDevices, "127.0.0.1:321", "/api/admin/devices?ips=80.2.3.121"); strings.Contains(rr.Body.String(), "Passed") {
+		t.Errorf("expected the expired device not to be listed to the admin, got %v", rr.Body)
+	}
+	if rr := get(t, ListExternalAddresses, "127.0.0.1:321", "/api/admin/ips"); strings.Contains(rr.Body.String(), `"80.2.3.121"`) {
+		t.Errorf("expected the expired device not to be counted, got %v", rr.Body)
+	}
+}
+
+func TestListNDJSON(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.82:321", `{"name":"One","address":"192.168.100.72"}`)
+	post(t, RegisterDevice, "80.2.3.82:321", `{"name":"Two","address":"192.168.100.73"}`)
+
+	for _, accept := range []string{"application/x-ndjson", "application/x-ndjson, application/json;q=0.9, */*;q=0.1"} {
+		req := httptest.NewRequest("GET", "/api/devices", nil)
+		req.RemoteAddr = "80.2.3.82:321"
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		ListDevices(rr, req)
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("%q: got Content-Type %q", accept, ct)
+		}
+		lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("%q: expected one line per device, got %q", accept, rr.Body.String())
+		}
+		for i, name := range []string{"One", "Two"} {
+			var d Device
+			if err := json.Unmarshal([]byte(lines[i]), &d); err != nil || d.Name != name {
+				t.Errorf("%q: line %d: got %q - %v", accept, i, lines[i], err)
+			}
+		}
+	}
+}
+
+func TestPrefers(t *testing.T) {
+	for _, c := range []struct {
+		accept []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"application/x-ndjson"}, true},
+		{[]string{"Application/X-NDJSON; charset=utf-8"}, true},
+		{[]string{"application/x-ndjson, */*;q=0.1"}, true},
+		{[]string{"application/json;q=0.9,application/x-ndjson"}, true},
+		{[]string{"application/json", "application/x-ndjson;q=0.5"}, false},
+		{[]string{"application/*;q=0.5, application/x-ndjson;q=0"}, false},
+		{[]string{"*/*"}, false},
+		{[]string{"application/x-ndjson;q=2"}, false},
+	} {
+		req := httptest.NewRequest("GET", "/api/devices", nil)
+		for _, v := range c.accept {
+			req.Header.Add("Accept", v)
+		}
+		if got := prefers(req, "application/x-ndjson"); got != c.want {
+			t.Errorf("%q: got %v want %v", c.accept, got, c.want)
+		}
+	}
+}
+
+func TestTimeoutHandlerStreams(t *testing.T) {
+	// http.TimeoutHandler doesn't support flushing, the streams must bypass it.
+	h := timeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}), time.Minute)
+
+	for _, c := range []struct {
+		target, accept string
+		code           int
+	}{
+		{"/api/devices", "application/x-ndjson", http.StatusOK},
+		{"/t/acme/api/devices", "application/x-ndjson", http.StatusOK},
+		{"/api/devices", "application/x-ndjson, */*;q=0.1", http.StatusOK},
+		{"/api/devices", "application/json", http.StatusInternalServerError},
+		{"/api/devices", "application/json, application/x-ndjson;q=0.5", http.StatusInternalServerError},
+		{"/api/register", "application/x-ndjson", http.StatusInternalServerError},
+	} {
+		req := httptest.NewRequest("GET", c.target, nil)
+		req.Header.Set("Accept", c.accept)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != c.code {
+			t.Errorf("%s %s: got %d want %d", c.target, c.accept, rr.Code, c.code)
+		}
+	}
+}
+
+func TestPortGrace(t *testing.T) {
+	forget("80.2.3.83")
+	defer func(g time.Duration) { portGrace = g }(portGrace)
+	portGrace = time.Minute
+
+	token := post(t, RegisterDevice, "80.2.3.83:321", `{"name":"Grace","address":"192.168.100.74","port":[8080,8443]}`).Header().Get("X-Device-Token")
+	postToken(t, RegisterDevice, "80.2.3.83:321", token, `{"name":"Grace","address":"192.168.100.74","port":8443}`)
+
+	var ds []Device
+	if err := json.Unmarshal(get(t, ListDevices, "80.2.3.83:321", "/api/devices").Body.Bytes(), &ds); err != nil || len(ds) != 1 {
+		t.Fatalf("got %v - %v", ds, err)
+	}
+	if p := ds[0].PreviousPorts; len(p) != 1 || p[0].Port != 8080 || !p[0].Until.After(time.Now()) {
+		t.Errorf("expected 8080 in previous_ports, got %v", p)
+	}
+
+	postToken(t, RegisterDevice, "80.2.3.83:321", token, `{"name":"Grace","address":"192.168.100.74","port":8080}`)
+	devices.RLock()
+	i, ok := findDevice("192.168.100.74", owner{ea: "80.2.3.83"})
+	if !ok {
+		devices.RUnlock()
+		t.Fatal("the device is not registered anymore")
+	}
+	p := devices.d[i].PreviousPorts
+	devices.RUnlock()
+	if len(p) != 1 || p[0].Port != 8443 {
+		t.Errorf("expected only 8443 in previous_ports once 8080 is back, got %v", p)
+	}
+
+	devices.Lock()
+	devices.d[i].PreviousPorts[0].Until = time.Now().Add(-time.Second)
+	devices.Unlock()
+	expire()
+	devices.RLock()
+	i, _ = findDevice("192.168.100.74", owner{ea: "80.2.3.83"})
+	p = devices.d[i].PreviousPorts
+	devices.RUnlock()
+	if len(p) != 0 {
+		t.Errorf("expected expired previous ports to be purged, got %v", p)
+	}
+}
+
+func TestListNear(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.84:321", `{"name":"Far","address":"192.168.1.10"}`)
+	post(t, RegisterDevice, "80.2.3.84:321", `{"name":"Near","address":"192.168.2.10"}`)
+	post(t, RegisterDevice, "80.2.3.84:321", `{"name":"Farther","address":"10.0.0.10"}`)
+
+	var ds []Device
+	if err := json.Unmarshal(get(t, ListDevices, "80.2.3.84:321", "/api/devices?near=192.168.2.0/24").Body.Bytes(), &ds); err != nil || len(ds) != 3 {
+		t.Fatalf("got %v - %v", ds, err)
+	}
+	for i, name := range []string{"Near", "Far", "Farther"} {
+		if ds[i].Name != name {
+			t.Errorf("expected %s at %d, got %s", name, i, ds[i].Name)
+		}
+	}
+
+	if rr := get(t, ListDevices, "80.2.3.84:321", "/api/devices?near=192.168.2"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid CIDR, got %d", rr.Code)
+	}
+	if rr := get(t, ListDevices, "80.2.3.84:321", "/api/devices?near=auto"); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 with near=auto, got %d", rr.Code)
+	}
+}
+
+func TestListSortPriority(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.85:321", `{"name":"Secondary","address":"192.168.100.75","priority":10}`)
+	post(t, RegisterDevice, "80.2.3.85:321", `{"name":"Primary","address":"192.168.100.76","priority":100}`)
+	post(t, RegisterDevice, "80.2.3.85:321", `{"name":"Default","address":"192.168.100.77"}`)
+
+	var ds []Device
+	if err := json.Unmarshal(get(t, ListDevices, "80.2.3.85:321", "/api/devices?sort=priority").Body.Bytes(), &ds); err != nil || len(ds) != 3 {
+		t.Fatalf("got %v - %v", ds, err)
+	}
+	for i, name := range []string{"Primary", "Secondary", "Default"} {
+		if ds[i].Name != name {
+			t.Errorf("expected %s at %d, got %s", name, i, ds[i].Name)
+		}
+	}
+
+	if rr := get(t, ListDevices, "80.2.3.85:321", "/api/devices?sort=name"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown sort, got %d", rr.Code)
+	}
+	if rr := post(t, RegisterDevice, "80.2.3.85:321", `{"name":"Over","address":"192.168.100.78","priority":1001}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an out of range priority, got %d", rr.Code)
+	}
+}
+
+func TestExpireRefreshedSinceScan(t *testing.T) {
+	forget("80.2.3.86")
+	token := post(t, RegisterDevice, "80.2.3.86:321", `{"name":"Refreshed","address":"192.168.100.79"}`).Header().Get("X-Device-Token")
+	o := owner{ea: "80.2.3.86"}
+
+	devices.Lock()
+	i, _ := findDevice("192.168.100.79", o)
+	devices.d[i].LastSeen = time.Now().Add(-lifetime - offlineGrace - expiryJitter - time.Minute)
+	d := devices.d[i]
+	devices.Unlock()
+
+	// Refreshed after cleanup found it expired, before it takes the write lock.
+	candidates := map[deviceKey]time.Time{d.key(): d.Added}
+	postToken(t, RegisterDevice, "80.2.3.86:321", token, `{"name":"Refreshed","address":"192.168.100.79"}`)
+	expireDevices(candidates)
+
+	devices.RLock()
+	_, ok := findDevice("192.168.100.79", o)
+	devices.RUnlock()
+	if !ok {
+		t.Error("expected the refreshed device to survive the cleanup")
+	}
+}
+
+func TestExpireConcurrentRegister(t *testing.T) {
+	forget("80.2.3.87")
+	o := owner{ea: "80.2.3.87"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Replaced when the device is added again after it expired.
+		var token string
+		register := func() {
+			rr := postToken(t, RegisterDevice, "80.2.3.87:321", token, `{"name":"Busy","address":"192.168.100.80"}`)
+			if issued := rr.Header().Get("X-Device-Token"); issued != "" {
+				token = issued
+			}
+		}
+		for i := 0; i < 200; i++ {
+			register()
+			devices.Lock()
+			if i, ok := findDevice("192.168.100.80", o); ok {
+				// Expired again right away, for cleanup to race with the next refresh.
+				devices.d[i].LastSeen = time.Now().Add(-lifetime - offlineGrace - expiryJitter - time.Minute)
+			}
+			devices.Unlock()
+		}
+		register()
+	}()
+	for {
+		select {
+		case <-done:
+			expire()
+			devices.RLock()
+			_, ok := findDevice("192.168.100.80", o)
+			devices.RUnlock()
+			if !ok {
+				t.Error("expected the device refreshed last to survive the cleanup")
+			}
+			return
+		default:
+			expire()
+		}
+	}
+}
+
+func TestListSignature(t *testing.T) {
+	defer func(key string) { signKey = key }(signKey)
+	signKey = "secret"
+
+	post(t, RegisterDevice, "80.2.3.91:321", `{"name":"Signed","address":"192.168.100.85"}`)
+	rr := get(t, ListDevices, "80.2.3.91:321", "/api/devices")
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(rr.Body.Bytes())
+	if got, want := rr.Header().Get("X-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("got X-Signature %q, want %q", got, want)
+	}
+
+	signKey = ""
+	if s := get(t, ListDevices, "80.2.3.91:321", "/api/devices").Header().Get("X-Signature"); s != "" {
+		t.Errorf("expected no signature without -sign-key, got %q", s)
+	}
+}
+
+func TestRegisterSpoofedHost(t *testing.T) {
+	forget("80.2.3.92")
+	defer func(h string) { allowedHosts = h }(allowedHosts)
+	allowedHosts = "discover.example.org"
+
+	req := httptest.NewRequest("POST", "/api/register", strings.NewReader(`{"name":"Spoofed","address":"192.168.100.86"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "80.2.3.92:321"
+	req.Host = "phishing.example"
+	rr := httptest.NewRecorder()
+	RegisterDevice(rr, req)
+
+	if strings.Contains(rr.Body.String(), "phishing.example") {
+		t.Errorf("expected the spoofed host not to be reflected, got %q", rr.Body)
+	}
+	if expected := "Successfully added, visit https://localhost:8180 for more.\n"; rr.Body.String() != expected {
+		t.Errorf("got %q want %q", rr.Body, expected)
+	}
+
+	// The scheme is only taken from the local proxy, and must be http or https.
+	for _, c := range []struct{ remote, proto, expected string }{
+		{"80.2.3.92:321", "javascript", "https://discover.example.org"},
+		{"80.2.3.92:321", "http", "https://discover.example.org"},
+		{"127.0.0.1:321", "javascript://phishing.example/", "https://discover.example.org"},
+		{"127.0.0.1:321", "http", "http://discover.example.org"},
+	} {
+		req := httptest.NewRequest("POST", "/api/register", nil)
+		req.Header.Set("X-Forwarded-Proto", c.proto)
+		req.RemoteAddr = c.remote
+		req.Host = "discover.example.org"
+		if got := publicBaseURL(req); got != c.expected {
+			t.Errorf("%s with X-Forwarded-Proto %q: got %q want %q", c.remote, c.proto, got, c.expected)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	forget("80.2.3.93")
+	rr := post(t, RegisterDevice, "80.2.3.93:321", `{"name":"Capable","address":"192.168.100.87","capabilities":{"supports_tls":true,"api_version":3}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d - %v", rr.Code, rr.Body)
+	}
+
+	var ds []Device
+	if err := json.Unmarshal(get(t, ListDevices, "80.2.3.93:321", "/api/devices").Body.Bytes(), &ds); err != nil || len(ds) != 1 {
+		t.Fatalf("got %v - %v", ds, err)
+	}
+	if c := ds[0].Capabilities; c == nil || *c != (Capabilities{SupportsTLS: true, APIVersion: 3}) {
+		t.Errorf("got capabilities %+v", c)
+	}
+
+	for _, body := range []string{
+		`{"name":"Capable","address":"192.168.100.88","capabilities":{"supports_ipv6":true}}`,
+		`{"name":"Capable","address":"192.168.100.88","capabilities":{"supports_tls":"yes"}}`,
+		`{"name":"Capable","address":"192.168.100.88","capabilities":{"api_version":-1}}`,
+	} {
+		if rr := post(t, RegisterDevice, "80.2.3.93:321", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestListFields(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.94:321", `{"name":"Projected","address":"192.168.100.89","port":8080}`)
+
+	rr := get(t, ListDevices, "80.2.3.94:321", "/api/devices?fields=name,internaladdress,port")
+	var ds []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &ds); err != nil || len(ds) != 1 {
+		t.Fatalf("got %v - %v", rr.Body, err)
+	}
+	if len(ds[0]) != 3 || ds[0]["name"] != "Projected" || ds[0]["internaladdress"] != "192.168.100.89" || ds[0]["port"] != 8080.0 {
+		t.Errorf("expected only the selected fields, got %v", ds[0])
+	}
+
+	if rr := get(t, ListDevices, "80.2.3.94:321", "/api/devices?fields=name,password"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown field, got %d", rr.Code)
+	}
+	if rr := get(t, ListDevices, "80.2.3.94:321", "/api/devices?fields=address"); rr.Body.String() != "192.168.100.89:8080\n" {
+		t.Errorf("expected fields=address to stay the plain list, got %q", rr.Body)
+	}
+}
+
+func TestRegisterAddresses(t *testing.T) {
+	forget("80.2.3.95")
+	rr := post(t, RegisterDevice, "80.2.3.95:321", `{"name":"Dual","address":"192.168.100.90","addresses":["fd00::5","192.168.100.90"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %d - %v", rr.Code, rr.Body)
+	}
+	post(t, RegisterDevice, "80.2.3.95:321", `{"name":"Implicit","addresses":["192.168.100.91","fd00::6"]}`)
+	post(t, RegisterDevice, "80.2.3.95:321", `{"name":"Single","address":"192.168.100.92"}`)
+
+	var ds []Device
+	if err := json.Unmarshal(get(t, ListDevices, "80.2.3.95:321", "/api/devices").Body.Bytes(), &ds); err != nil || len(ds) != 3 {
+		t.Fatalf("got %v - %v", ds, err)
+	}
+	for i, tc := range []struct {
+		address   string
+		addresses []string
+	}{
+		{"192.168.100.90", []string{"192.168.100.90", "fd00::5"}},
+		{"192.168.100.91", []string{"192.168.100.91", "fd00::6"}},
+		{"192.168.100.92", nil},
+	} {
+		if ds[i].InternalAddress != tc.address || !slices.Equal(ds[i].Addresses, tc.addresses) {
+			t.Errorf("%d: got %s %v, want %s %v", i, ds[i].InternalAddress, ds[i].Addresses, tc.address, tc.addresses)
+		}
+	}
+
+	if rr := post(t, RegisterDevice, "80.2.3.95:321", `{"name":"Dual","address":"192.168.100.93","addresses":["::1"]}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected each address to be validated, got %d", rr.Code)
+	}
+}
+
+func TestExpireBatches(t *testing.T) {
+	defer func(n int) { cleanupBatch = n }(cleanupBatch)
+	cleanupBatch = 2
+
+	old := time.Now().Add(-lifetime - offlineGrace - expiryJitter - time.Minute)
+	devices.Lock()
+	saved := devices.d
+	var d []Device
+	for i := 0; i < 5; i++ {
+		d = append(d, Device{ExternalAddress: "80.2.3.96", InternalAddress: fmt.Sprintf("192.168.101.%d", i), Added: old, LastSeen: old})
+	}
+	setDevices(append(d, Device{ExternalAddress: "80.2.3.96", InternalAddress: "192.168.101.10", Added: old, LastSeen: time.Now()}))
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		setDevices(saved)
+		devices.Unlock()
+	}()
+
+	expire()
+
+	devices.RLock()
+	defer devices.RUnlock()
+	if len(devices.d) != 1 || devices.d[0].InternalAddress != "192.168.101.10" {
+		t.Errorf("expected every expired device to be removed over the batches, got %v", devices.d)
+	}
+}
+
+func BenchmarkExpireMass(b *testing.B) {
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(io.Discard)
+
+	devices.Lock()
+	saved := devices.d
+	devices.Unlock()
+	defer func() {
+		devices.Lock()
+		setDevices(saved)
+		devices.Unlock()
+	}()
+
+	const n = 10000
+	old := time.Now().Add(-lifetime - offlineGrace - expiryJitter - time.Minute)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		devices.Lock()
+		d := make([]Device, 0, 2*n)
+		for j := 0; j < n; j++ {
+			d = append(d,
+				Device{ExternalAddress: "80.2.3.97", InternalAddress: fmt.Sprintf("10.%d.%d.1", j/256, j%256), Added: old, LastSeen: old},
+				Device{ExternalAddress: "80.2.3.97", InternalAddress: fmt.Sprintf("10.%d.%d.2", j/256, j%256), Added: old, LastSeen: time.Now()})
+		}
+		setDevices(d)
+		devices.Unlock()
+		b.StartTimer()
+
+		expire()
+	}
+}
+
+func TestIndexAfterRemoval(t *testing.T) {
+	defer func(w time.Duration) { tombstoneWindow = w }(tombstoneWindow)
+	tombstoneWindow = 0
+
+	rr := post(t, RegisterDevice, "80.2.3.98:321", `{"name":"Removed","address":"192.168.100.94"}`)
+	post(t, RegisterDevice, "80.2.3.98:321", `{"name":"Kept","address":"192.168.100.95"}`)
+	req := httptest.NewRequest("POST", "/api/unregister", strings.NewReader(`{"address":"192.168.100.94"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Device-Token", rr.Header().Get("X-Device-Token"))
+	req.RemoteAddr = "80.2.3.98:321"
+	UnregisterDevice(httptest.NewRecorder(), req)
+	post(t, RegisterDevice, "80.2.3.98:321", `{"name":"Added","address":"192.168.100.96"}`)
+
+	devices.RLock()
+	defer devices.RUnlock()
+	if _, fresh := byExternalAddress("80.2.3.98"); !fresh {
+		t.Error("expected the index to be rebuilt")
+	}
+	o := owner{ea: "80.2.3.98"}
+	for _, ia := range []string{"192.168.100.95", "192.168.100.96"} {
+		if i, ok := findDevice(ia, o); !ok || devices.d[i].InternalAddress != ia {
+			t.Errorf("%s: expected to be found, got %d %v", ia, i, ok)
+		}
+	}
+	if _, ok := findDevice("192.168.100.94", o); ok {
+		t.Error("expected the removed device not to be found")
+	}
+	if ds := devicesFor(o, filter{}); len(ds) != 2 || ds[0].Name != "Kept" || ds[1].Name != "Added" {
+		t.Errorf("expected the devices in registration order, got %v", ds)
+	}
+}
+
+func TestIndexAfterSwapDelete(t *testing.T) {
+	devices.Lock()
+	defer devices.Unlock()
+	saved := devices.d
+	defer func() {
+		setDevices(saved)
+		reindex()
+	}()
+
+	// Removing the first device by swapping the last one in, then adding one
+	// leaves a slice of the same length and array as the indexed one.
+	setDevices([]Device{{ExternalAddress: "80.2.3.122", InternalAddress: "192.168.100.129"}, {ExternalAddress: "80.2.3.123", InternalAddress: "192.168.100.130"}})
+	reindex()
+	devices.d[0] = devices.d[1]
+	setDevices(devices.d[:1])
+	setDevices(append(devices.d, Device{ExternalAddress: "80.2.3.122", InternalAddress: "192.168.100.131"}))
+	if _, fresh := byExternalAddress("80.2.3.122"); fresh {
+		t.Error("expected the index to be out of date")
+	}
+	for i, d := range devices.d {
+		if j, ok := findDevice(d.InternalAddress, owner{ea: d.ExternalAddress}); !ok || j != i {
+			t.Errorf("%s: expected to be found at %d, got %d %v", d.InternalAddress, i, j, ok)
+		}
+	}
+	if _, ok := findDevice("192.168.100.129", owner{ea: "80.2.3.122"}); ok {
+		t.Error("expected the removed device not to be found")
+	}
+
+	// Nor is an index of removed devices used for an empty slice.
+	reindex()
+	setDevices(devices.d[:0])
+	if _, ok := findDevice("192.168.100.130", owner{ea: "80.2.3.123"}); ok {
+		t.Error("expected no device to be found")
+	}
+}
+
+// benchmarkDevices swaps the devices for n of them spread over 100 external
+// addresses, indexed or not.
+func benchmarkDevices(b *testing.B, n int, indexed bool) {
+	devices.Lock()
+	saved := devices.d
+	d := make([]Device, 0, n)
+	for i := 0; i < n; i++ {
+		d = append(d, Device{ExternalAddress: fmt.Sprintf("80.3.0.%d", i%100), InternalAddress: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+	}
+	setDevices(d)
+	if indexed {
+		reindex()
+	}
+	devices.Unlock()
+	b.Cleanup(func() {
+		devices.Lock()
+		setDevices(saved)
+		reindex()
+		devices.Unlock()
+	})
+}
+
+func BenchmarkFindDevice(b *testing.B) {
+	for _, indexed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("indexed=%v", indexed), func(b *testing.B) {
+			benchmarkDevices(b, 10000, indexed)
+			o := owner{ea: "80.3.0.99"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := findDevice("10.0.39.15", o); !ok {
+					b.Fatal("not found")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDevicesFor(b *testing.B) {
+	for _, indexed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("indexed=%v", indexed), func(b *testing.B) {
+			benchmarkDevices(b, 10000, indexed)
+			o := owner{ea: "80.3.0.42"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if ds := devicesFor(o, filter{}); len(ds) != 100 {
+					b.Fatalf("got %d devices", len(ds))
+				}
+			}
+		})
+	}
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	forget("80.2.3.99")
+	defer func(b bool) { requireHTTPS = b }(requireHTTPS)
+	requireHTTPS = true
+
+	h := httpsOnly(RegisterDevice)
+	var token string
+	for _, tc := range []struct {
+		remote, proto string
+		tls           bool
+		status        int
+	}{
+		{"127.0.0.1:321", "http", false, http.StatusUpgradeRequired},
+		{"127.0.0.1:321", "https", false, http.StatusOK},
+		{"80.2.3.99:321", "https", false, http.StatusUpgradeRequired},
+		{"80.2.3.99:321", "", true, http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/api/register", strings.NewReader(`{"name":"Secure","address":"192.168.100.99"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Real-IP", "80.2.3.99")
+		req.RemoteAddr = tc.remote
+		if tc.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		req.Header.Set("X-Device-Token", token)
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		if issued := rr.Header().Get("X-Device-Token"); issued != "" {
+			token = issued
+		}
+		if rr.Code != tc.status {
+			t.Errorf("%s %q tls=%v: got %d want %d - %v", tc.remote, tc.proto, tc.tls, rr.Code, tc.status, rr.Body)
+		}
+	}
+
+	if rr := get(t, ListDevices, "80.2.3.99:321", "/api/devices"); rr.Code != http.StatusOK {
+		t.Errorf("expected listing over HTTP to stay allowed, got %d", rr.Code)
+	}
+}
+
+func TestRegisterOnlyIfAbsent(t *testing.T) {
+	forget("80.2.3.101")
+	const claims = 50
+
+	codes := make(chan int, claims)
+	var wg sync.WaitGroup
+	for i := 0; i < claims; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"name":"leader","address":"192.168.102.%d","only_if_absent":true}`, i+1)
+			codes <- post(t, RegisterDevice, "80.2.3.101:321", body).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	won := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if won != 1 {
+		t.Errorf("expected exactly one claim to win, got %d", won)
+	}
+
+	devices.RLock()
+	n := len(devicesFor(owner{ea: "80.2.3.101"}, filter{}))
+	devices.RUnlock()
+	if n != 1 {
+		t.Errorf("expected one device, got %d", n)
+	}
+}
+
+func TestTimesInUTC(t *testing.T) {
+	defer func(l *time.Location) { time.Local = l }(time.Local)
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+
+	post(t, RegisterDevice, "80.2.3.102:321", `{"name":"Zoned","address":"192.168.102.100","expires_at":"`+time.Now().Add(time.Hour).In(time.FixedZone("UTC-3", -3*60*60)).Format(time.RFC3339)+`"}`)
+
+	var ds []map[string]interface{}
+	if err := json.Unmarshal(get(t, ListDevices, "80.2.3.102:321", "/api/devices").Body.Bytes(), &ds); err != nil || len(ds) != 1 {
+		t.Fatalf("got %v - %v", ds, err)
+	}
+	for _, field := range []string{"added", "last_seen", "expires_at"} {
+		if v, _ := ds[0][field].(string); !strings.HasSuffix(v, "Z") {
+			t.Errorf("%s: expected an RFC 3339 UTC time, got %q", field, v)
+		}
+	}
+
+	// Times kept in another zone, e.g. by older dumps, are output in UTC too.
+	d := Device{Added: time.Now().In(time.Local), LastSeen: time.Now().In(time.Local)}
+	b, err := json.Marshal(d)
+	if err != nil || strings.Contains(string(b), "+05:00") {
+		t.Errorf("expected no time zone offset, got %s - %v", b, err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sync/atomic"
+)
+
+// massExpiryMinDevices is the number of devices under which no expiry is
+// reported as a mass expiry, one device out of two isn't an outage.
+const massExpiryMinDevices = 10
+
+var (
+	expiredTotal     atomic.Uint64 // devices removed on timeout since the start
+	lastExpiredRatio atomic.Uint64 // float64 bits, fraction of the devices expired by the last cleanup
+)
+
+// checkMassExpiry records that expired of the live devices expired in one
+// cleanup, and reports it per -mass-expiry-action when they are more than
+// -mass-expiry-threshold of them: many devices expiring together rather
+// means that their network, or the path to the service, is down.
+func checkMassExpiry(expired, live int) {
+	ratio := 0.0
+	if live > 0 {
+		ratio = float64(expired) / float64(live)
+	}
+	lastExpiredRatio.Store(math.Float64bits(ratio))
+
+	if massExpiryThreshold <= 0 || live < massExpiryMinDevices || ratio <= massExpiryThreshold {
+		return
+	}
+	log.Printf("Warning: mass expiry, %d of %d devices (%.0f%%) expired in one cleanup", expired, live, ratio*100)
+	if massExpiryAction != "webhook" || webhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Event    string  `json:"event"`
+		Expired  int     `json:"expired"`
+		Devices  int     `json:"devices"`
+		Fraction float64 `json:"fraction"`
+	}{"mass_expiry", expired, live, ratio})
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+	deliver("mass_expiry", body)
+}
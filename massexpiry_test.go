@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckMassExpiry(t *testing.T) {
+	events := make(chan map[string]interface{}, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		events <- body
+	}))
+	defer srv.Close()
+	defer func(u string, threshold float64, action string) {
+		webhookURL, massExpiryThreshold, massExpiryAction = u, threshold, action
+	}(webhookURL, massExpiryThreshold, massExpiryAction)
+	webhookURL, massExpiryThreshold, massExpiryAction = srv.URL, 0.5, "webhook"
+
+	checkMassExpiry(5, 10) // at the threshold
+	checkMassExpiry(2, 3)  // too few devices
+	if got := math.Float64frombits(lastExpiredRatio.Load()); got != 2.0/3 {
+		t.Errorf("expected the ratio of the last cleanup, got %v", got)
+	}
+	checkMassExpiry(8, 10)
+	waitWebhooks(t.Context())
+
+	select {
+	case e := <-events:
+		if e["event"] != "mass_expiry" || e["expired"] != 8.0 || e["devices"] != 10.0 {
+			t.Errorf("unexpected notification %v", e)
+		}
+	default:
+		t.Fatal("expected the mass expiry to be notified")
+	}
+	if len(events) != 0 {
+		t.Errorf("expected a single notification, got %v more", len(events))
+	}
+
+	massExpiryAction = "warn"
+	checkMassExpiry(8, 10)
+	waitWebhooks(t.Context())
+	if len(events) != 0 {
+		t.Error("expected no notification with -mass-expiry-action warn")
+	}
+}
+
+func TestExpiredTotal(t *testing.T) {
+	post(t, RegisterDevice, "80.2.3.110:321", `{"name":"Gone","address":"192.168.100.111"}`)
+	devices.Lock()
+	i, _ := findDevice("192.168.100.111", owner{ea: "80.2.3.110"})
+	devices.d[i].LastSeen = time.Now().Add(-lifetime - offlineGrace - expiryJitter - time.Minute)
+	devices.Unlock()
+
+	before := expiredTotal.Load()
+	expire()
+	if after := expiredTotal.Load(); after <= before {
+		t.Errorf("expected the expired counter to increase, got %d then %d", before, after)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+)
+
+// Metrics exposes counters in the Prometheus text format.
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	devices.RLock()
+	registrations := devices.registrations
+	var current, deleted int
+	for _, d := range devices.d {
+		if d.live() {
+			current++
+		} else if !d.Deleted.IsZero() {
+			deleted++
+		}
+	}
+	devices.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	var body bytes.Buffer
+	metric(&body, "nupnp_registrations_total", "counter", "Registrations handled since the first start.", registrations)
+	metric(&body, "nupnp_devices", "gauge", "Devices currently registered.", current)
+	metric(&body, "nupnp_tombstones", "gauge", "Unregistered devices kept until the end of the -tombstone-window.", deleted)
+	metric(&body, "nupnp_expired_total", "counter", "Devices removed because they stopped registering, since the start.", expiredTotal.Load())
+	metric(&body, "nupnp_last_cleanup_expired_ratio", "gauge", "Fraction of the devices removed on timeout by the last cleanup.", math.Float64frombits(lastExpiredRatio.Load()))
+	devices.writeMetrics(&body)
+	if _, err := body.WriteTo(w); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+func metric(w io.Writer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistrationsCounter(t *testing.T) {
+	forget("80.2.3.73")
+	devices.RLock()
+	before := devices.registrations
+	devices.RUnlock()
+
+	token := post(t, RegisterDevice, "80.2.3.73:321", `{"name":"Device","address":"192.168.100.62"}`).Header().Get("X-Device-Token")
+	postToken(t, RegisterDevice, "80.2.3.73:321", token, `{"name":"Device","address":"192.168.100.62"}`)
+
+	rr := get(t, Metrics, "80.2.3.73:321", "/metrics")
+	if want := fmt.Sprintf("nupnp_registrations_total %d\n", before+2); !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("expected %q in the metrics, got %v", want, rr.Body.String())
+	}
+
+	// The counter survives restarts.
+	path := filepath.Join(t.TempDir(), "dump")
+	if err := saveDevices(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, registrations, err := loadDevices(path); err != nil || registrations != before+2 {
+		t.Errorf("restored %v registrations, want %v - %v", registrations, before+2, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import "unicode/utf8"
+
+//go:generate go run nfc_gen.go
+
+// Hangul syllables are composed of a leading consonant, a vowel and an
+// optional trailing consonant, they are decomposed and composed
+// algorithmically (Unicode 3.12).
+const (
+	hangulBase  = 0xAC00
+	hangulL     = 0x1100
+	hangulV     = 0x1161
+	hangulT     = 0x11A7
+	hangulLs    = 19
+	hangulVs    = 21
+	hangulTs    = 28
+	hangulCount = hangulLs * hangulVs * hangulTs
+)
+
+// nfc returns s in the Unicode Normalization Form C, so that names which
+// look the same, e.g. with a composed or a decomposed "é", are equal.
+func nfc(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s
+	}
+
+	// Decompose canonically.
+	rs := make([]rune, 0, len(s))
+	for _, r := range s {
+		if h := r - hangulBase; h >= 0 && h < hangulCount {
+			rs = append(rs, hangulL+h/(hangulVs*hangulTs), hangulV+h%(hangulVs*hangulTs)/hangulTs)
+			if t := h % hangulTs; t != 0 {
+				rs = append(rs, hangulT+t)
+			}
+		} else if d, ok := nfcDecompositions[r]; ok {
+			rs = append(rs, []rune(d)...)
+		} else {
+			rs = append(rs, r)
+		}
+	}
+
+	// Put the combining marks following each starter in canonical order.
+	for i := 1; i < len(rs); i++ {
+		for j := i; j > 0 && nfcClasses[rs[j]] != 0 && nfcClasses[rs[j-1]] > nfcClasses[rs[j]]; j-- {
+			rs[j-1], rs[j] = rs[j], rs[j-1]
+		}
+	}
+
+	// Compose each mark with the last starter when no mark of the same or a
+	// higher class, or starter, comes between them.
+	out := rs[:1]
+	starter := 0
+	last := -1 // class of the last rune kept after the starter, -1 for none
+	if nfcClasses[rs[0]] != 0 {
+		last = 256 // marks can't compose without a starter
+	}
+	for _, r := range rs[1:] {
+		class := int(nfcClasses[r])
+		if c, ok := compose(out[starter], r); ok && (last == -1 || last < class) {
+			out[starter] = c
+			continue
+		}
+		if class == 0 {
+			starter, last = len(out), -1
+		} else {
+			last = class
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// compose returns the primary composite of a and b, if any.
+func compose(a, b rune) (rune, bool) {
+	if l := a - hangulL; l >= 0 && l < hangulLs {
+		if v := b - hangulV; v >= 0 && v < hangulVs {
+			return hangulBase + (l*hangulVs+v)*hangulTs, true
+		}
+	}
+	if h := a - hangulBase; h >= 0 && h < hangulCount && h%hangulTs == 0 {
+		if t := b - hangulT; t > 0 && t < hangulTs {
+			return a + t, true
+		}
+	}
+	c, ok := nfcCompositions[[2]rune{a, b}]
+	return c, ok
+}
@@ -0,0 +1,86 @@
+//go:build ignore
+
+// nfc_gen.go generates nfc_tables.go, the Unicode data used by nfc, from
+// golang.org/x/text/unicode/norm, which the service itself doesn't depend
+// on. Run it with x/text in the GOPATH: go run nfc_gen.go
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func main() {
+	var classes, decompositions, compositions bytes.Buffer
+	var nc, nd, np int
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		// Hangul syllables are decomposed and composed algorithmically.
+		if !utf8.ValidRune(r) || (r >= 0xAC00 && r <= 0xD7A3) {
+			continue
+		}
+		s := string(r)
+		if ccc := norm.NFD.PropertiesString(s).CCC(); ccc != 0 {
+			fmt.Fprintf(&classes, "0x%04X: %d, ", r, ccc)
+			if nc++; nc%8 == 0 {
+				classes.WriteString("\n")
+			}
+		}
+		d := norm.NFD.String(s)
+		if d == s {
+			continue
+		}
+		fmt.Fprintf(&decompositions, "0x%04X: %+q, ", r, d)
+		if nd++; nd%4 == 0 {
+			decompositions.WriteString("\n")
+		}
+
+		// Primary composites: the first part of the decomposition composes
+		// back to a single rune, which composes with the last one into r.
+		if norm.NFC.String(s) != s {
+			continue
+		}
+		ds := []rune(d)
+		first := []rune(norm.NFC.String(string(ds[:len(ds)-1])))
+		last := ds[len(ds)-1]
+		if len(first) != 1 || norm.NFC.String(string(first[0])+string(last)) != s {
+			log.Fatalf("unexpected decomposition of %U: %+q", r, d)
+		}
+		fmt.Fprintf(&compositions, "{0x%04X, 0x%04X}: 0x%04X, ", first[0], last, r)
+		if np++; np%4 == 0 {
+			compositions.WriteString("\n")
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `// Code generated by "go run nfc_gen.go" from Unicode %s. DO NOT EDIT.
+
+package main
+
+// nfcClasses are the non-zero canonical combining classes.
+var nfcClasses = map[rune]uint8{
+%s}
+
+// nfcDecompositions are the full canonical decompositions.
+var nfcDecompositions = map[rune]string{
+%s}
+
+// nfcCompositions are the primary composites of pairs of runes.
+var nfcCompositions = map[[2]rune]rune{
+%s}
+`, norm.Version, classes.String(), decompositions.String(), compositions.String())
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("nfc_tables.go", src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
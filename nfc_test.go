@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestNFC(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"Printer", "Printer"},
+		{"Caf\u00e9", "Caf\u00e9"},
+		{"Cafe\u0301", "Caf\u00e9"},
+		{"A\u030a", "\u00c5"},
+		{"\u212b", "\u00c5"},              // Angstrom sign, a singleton
+		{"a\u0301\u0323", "\u1ea1\u0301"}, // marks put in canonical order first
+		{"a\u0323\u0301", "\u1ea1\u0301"},
+		{"\u1100\u1161\u11a8", "\uac01"},   // Hangul jamos
+		{"\uac00\u11a8", "\uac01"},         // Hangul syllable and trailing jamo
+		{"\u0301e", "\u0301e"},             // a leading mark has nothing to compose with
+		{"e\u0bd7\u0301", "e\u0bd7\u0301"}, // blocked by a starter
+		{"\ufb32", "\u05d2\u05bc"},         // excluded from composition
+		{"\U0001611e\U00016129", "\U00016122"},
+	} {
+		if out := nfc(tc.in); out != tc.out {
+			t.Errorf("nfc(%+q) = %+q, want %+q", tc.in, out, tc.out)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PickDevice returns one of the devices of the caller, chosen at random and
+// weighted by priority, for clients balancing their load over the devices
+// without listing them all. Only the devices with a positive priority are
+// picked, all of them evenly when none has one. The devices can be filtered
+// like in the list, by "tag" – e.g. their type – and "location", and by
+// "name". With a "seed", the same devices give the same pick.
+func PickDevice(w http.ResponseWriter, r *http.Request) {
+	o, ok := queryOwner(w, r)
+	if !ok {
+		return
+	}
+
+	rnd := rand.IntN
+	if s := r.URL.Query().Get("seed"); s != "" {
+		seed, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, `"seed" must be a positive number`, http.StatusBadRequest)
+			return
+		}
+		rnd = rand.New(rand.NewPCG(seed, 0)).IntN
+	}
+
+	f := queryFilter(r)
+	f.includeDeleted = false
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	devices.RLock()
+	ds := slices.DeleteFunc(devicesFor(o, f), func(d Device) bool {
+		return name != "" && d.Name != name
+	})
+	devices.RUnlock()
+
+	d, ok := pick(ds, rnd)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, d)
+}
+
+// pick chooses one of ds with rnd, see PickDevice.
+func pick(ds []Device, rnd func(int) int) (Device, bool) {
+	if len(ds) == 0 {
+		return Device{}, false
+	}
+	// In a stable order, for the seeded picks.
+	slices.SortFunc(ds, func(a, b Device) int { return strings.Compare(a.ID(), b.ID()) })
+
+	total := 0
+	for _, d := range ds {
+		total += max(d.Priority, 0)
+	}
+	if total == 0 {
+		return ds[rnd(len(ds))], true
+	}
+	n := rnd(total)
+	for _, d := range ds[:len(ds)-1] {
+		if n -= max(d.Priority, 0); n < 0 {
+			return d, true
+		}
+	}
+	return ds[len(ds)-1], true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestPickDevice(t *testing.T) {
+	forget("80.2.3.109")
+	if rr := get(t, PickDevice, "80.2.3.109:321", "/api/device/pick"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without devices, got %d", rr.Code)
+	}
+
+	post(t, RegisterDevice, "80.2.3.109:321", `{"name":"Heavy","address":"192.168.100.107","priority":9,"tags":["printer"]}`)
+	post(t, RegisterDevice, "80.2.3.109:321", `{"name":"Light","address":"192.168.100.108","priority":1,"tags":["printer"]}`)
+	post(t, RegisterDevice, "80.2.3.109:321", `{"name":"Never","address":"192.168.100.109","tags":["printer"]}`)
+	post(t, RegisterDevice, "80.2.3.109:321", `{"name":"Other","address":"192.168.100.110","priority":100}`)
+
+	picks := map[string]int{}
+	for range 1000 {
+		rr := get(t, PickDevice, "80.2.3.109:321", "/api/device/pick?tag=printer")
+		var d struct{ Name string }
+		if err := json.Unmarshal(rr.Body.Bytes(), &d); err != nil {
+			t.Fatalf("unexpected pick %v - %v", rr.Body, err)
+		}
+		picks[d.Name]++
+	}
+	if picks["Never"] != 0 || picks["Other"] != 0 || picks["Heavy"] < 800 || picks["Light"] < 50 {
+		t.Errorf("unexpected weighted picks %v", picks)
+	}
+
+	seeded := get(t, PickDevice, "80.2.3.109:321", "/api/device/pick?tag=printer&seed=42").Body.String()
+	for range 10 {
+		if got := get(t, PickDevice, "80.2.3.109:321", "/api/device/pick?tag=printer&seed=42").Body.String(); got != seeded {
+			t.Fatalf("expected the seeded pick to be reproducible, got %v then %v", seeded, got)
+		}
+	}
+
+	rr := get(t, PickDevice, "80.2.3.109:321", "/api/device/pick?name=Never")
+	var d struct{ Name string }
+	if err := json.Unmarshal(rr.Body.Bytes(), &d); err != nil || d.Name != "Never" {
+		t.Errorf("expected the only device named Never, got %v - %v", rr.Body, err)
+	}
+	if rr := get(t, PickDevice, "80.2.3.109:321", "/api/device/pick?seed=x"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid seed, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// hostPorts records when each port of the internal addresses of each network
+// was last registered, to spot clients mapping a host by registering many
+// ports for it.
+var hostPorts = struct {
+	sync.Mutex
+	hosts     map[hostKey]map[int]time.Time
+	lastSweep time.Time
+}{hosts: map[hostKey]map[int]time.Time{}}
+
+type hostKey struct {
+	ea, address string
+}
+
+// errTooManyPorts is returned when a registration goes over
+// -max-ports-per-host and -ports-action is "reject".
+var errTooManyPorts = errors.New("Too many ports registered for this address, try again later")
+
+// checkPorts tells whether the ports can be registered for address from ea.
+// Going over -max-ports-per-host distinct ports within -ports-window is
+// logged, and rejected when -ports-action is "reject". The ports only count
+// once recorded by recordPorts.
+func checkPorts(ea, address string, ports []int) bool {
+	if maxPortsPerHost <= 0 || len(ports) == 0 {
+		return true
+	}
+
+	hostPorts.Lock()
+	defer hostPorts.Unlock()
+
+	now := time.Now()
+	if now.Sub(hostPorts.lastSweep) > portsWindow {
+		for k, seen := range hostPorts.hosts {
+			for p, t := range seen {
+				if now.Sub(t) > portsWindow {
+					delete(seen, p)
+				}
+			}
+			if len(seen) == 0 {
+				delete(hostPorts.hosts, k)
+			}
+		}
+		hostPorts.lastSweep = now
+	}
+
+	k := hostKey{ea, address}
+	seen := hostPorts.hosts[k]
+	distinct := map[int]bool{}
+	for p, t := range seen {
+		if now.Sub(t) <= portsWindow {
+			distinct[p] = true
+		}
+	}
+	for _, p := range ports {
+		distinct[p] = true
+	}
+
+	if len(distinct) > maxPortsPerHost {
+		log.Println(logIP(ea), "registered", len(distinct), "ports for", logIP(address), "within", portsWindow, "this can be a port scan.")
+		if portsAction == "reject" {
+			return false
+		}
+	}
+	return true
+}
+
+// recordPorts counts the ports of an accepted registration of address from
+// ea in its -ports-window.
+func recordPorts(ea, address string, ports []int) {
+	if maxPortsPerHost <= 0 || len(ports) == 0 {
+		return
+	}
+
+	hostPorts.Lock()
+	defer hostPorts.Unlock()
+
+	k := hostKey{ea, address}
+	seen := hostPorts.hosts[k]
+	if seen == nil {
+		seen = map[int]time.Time{}
+		hostPorts.hosts[k] = seen
+	}
+	now := time.Now()
+	for _, p := range ports {
+		seen[p] = now
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMaxPortsPerHost(t *testing.T) {
+	forget("80.2.3.89", "80.2.3.90")
+	defer func(n int, action string) { maxPortsPerHost, portsAction = n, action }(maxPortsPerHost, portsAction)
+	maxPortsPerHost, portsAction = 3, "warn"
+
+	var token string
+	for _, body := range []string{
+		`{"name":"Scanned","address":"192.168.100.81","port":[1,2]}`,
+		`{"name":"Scanned","address":"192.168.100.81","port":[3]}`,
+		`{"name":"Scanned","address":"192.168.100.81","port":[4]}`,
+	} {
+		rr := postToken(t, RegisterDevice, "80.2.3.89:321", token, body)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected only a warning, got %d - %v", rr.Code, rr.Body)
+		}
+		if issued := rr.Header().Get("X-Device-Token"); issued != "" {
+			token = issued
+		}
+	}
+
+	portsAction = "reject"
+	if rr := postToken(t, RegisterDevice, "80.2.3.89:321", token, `{"name":"Scanned","address":"192.168.100.81","port":5}`); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over the limit, got %d", rr.Code)
+	}
+	rr := post(t, RegisterDevice, "80.2.3.90:321", `{"name":"Other","address":"192.168.100.81","port":[1,2,3]}`)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected other networks to be counted apart, got %d", rr.Code)
+	}
+	other := rr.Header().Get("X-Device-Token")
+	if rr := postToken(t, RegisterDevice, "80.2.3.90:321", other, `{"name":"Other","address":"192.168.100.81","port":[1,2,3]}`); rr.Code != http.StatusOK {
+		t.Errorf("expected the same ports to be counted once, got %d", rr.Code)
+	}
+	if rr := post(t, RegisterDevices, "80.2.3.90:321", `[{"name":"Fine","address":"192.168.100.82"},{"name":"Other","address":"192.168.100.81","port":4,"token":"`+other+`"}]`); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the bulk registration to be rejected, got %d", rr.Code)
+	}
+	devices.RLock()
+	_, ok := findDevice("192.168.100.82", owner{ea: "80.2.3.90"})
+	devices.RUnlock()
+	if ok {
+		t.Error("expected nothing to be registered from a rejected bulk registration")
+	}
+}
+
+func TestRefusedPortsNotRecorded(t *testing.T) {
+	forget("80.2.3.120")
+	defer func(n int, action string) { maxPortsPerHost, portsAction = n, action }(maxPortsPerHost, portsAction)
+	maxPortsPerHost, portsAction = 2, "reject"
+
+	rr := post(t, RegisterDevice, "80.2.3.120:321", `{"name":"Owned","address":"192.168.100.127","port":1}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the registration to succeed, got %d - %v", rr.Code, rr.Body)
+	}
+	token := rr.Header().Get("X-Device-Token")
+	for _, body := range []string{
+		`{"name":"Owned","address":"192.168.100.127","port":2}`,
+		`{"name":"Owned","address":"192.168.100.127","port":3,"only_if_absent":true}`,
+	} {
+		if rr := postToken(t, RegisterDevice, "80.2.3.120:321", "wrong", body); rr.Code != http.StatusForbidden && rr.Code != http.StatusConflict {
+			t.Errorf("expected the registration to be refused, got %d", rr.Code)
+		}
+	}
+	if rr := postToken(t, RegisterDevice, "80.2.3.120:321", token, `{"name":"Owned","address":"192.168.100.127","port":[1,4]}`); rr.Code != http.StatusOK {
+		t.Errorf("expected the refused ports not to be counted, got %d", rr.Code)
+	}
+}
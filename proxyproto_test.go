@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+		"\x50\x02\x03\x29" + "\x0a\x00\x00\x01" + "\x01\x41" + "\x01\xbb")
+
+	for _, tc := range []struct {
+		name, header, remote string
+	}{
+		{"v1 tcp4", "PROXY TCP4 80.2.3.41 10.0.0.1 321 443\r\n", "80.2.3.41:321"},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 321 443\r\n", "[2001:db8::1]:321"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "pipe"},
+		{"v2 tcp4", string(v2), "80.2.3.41:321"},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(tc.header + "GET / HTTP/1.1\r\n"))
+			client.Close()
+		}()
+
+		c := &proxyConn{Conn: server}
+		if remote := c.RemoteAddr().String(); remote != tc.remote {
+			t.Errorf("%s: got remote address %v want %v", tc.name, remote, tc.remote)
+		}
+		b, err := io.ReadAll(c)
+		if err != nil || string(b) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: got %q - %v, expected the request after the header", tc.name, b, err)
+		}
+	}
+}
+
+func TestProxyProtocolMissing(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n"))
+		client.Close()
+	}()
+
+	c := &proxyConn{Conn: server}
+	if _, err := c.Read(make([]byte, 16)); err != errProxyHeader {
+		t.Errorf("got %v, expected errProxyHeader", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// registerLimiter counts the registrations of each external address over
+// fixed windows of registerWindow.
+var registerLimiter = struct {
+	sync.Mutex
+	clients   map[string]*rateClient
+	lastSweep time.Time
+}{clients: map[string]*rateClient{}}
+
+type rateClient struct {
+	start    time.Time // beginning of the current window
+	count    int
+	rejected int       // consecutive rejections
+	retryAt  time.Time // end of the last suggested delay
+}
+
+// maxRetryAfter caps the delay suggested to clients that keep retrying.
+const maxRetryAfter = time.Hour
+
+// allowRegister records a registration from ea. When it goes over the limit,
+// it returns false and how long the client should wait before retrying.
+func allowRegister(ea string) (bool, time.Duration) {
+	if registerLimit <= 0 {
+		return true, 0
+	}
+
+	registerLimiter.Lock()
+	defer registerLimiter.Unlock()
+
+	now := time.Now()
+	if now.Sub(registerLimiter.lastSweep) > registerWindow {
+		for ea, c := range registerLimiter.clients {
+			// Rejected clients are kept until they may retry, so that the
+			// delay keeps doubling if they don't wait.
+			if now.Sub(c.start) > registerWindow && now.After(c.retryAt) {
+				delete(registerLimiter.clients, ea)
+			}
+		}
+		registerLimiter.lastSweep = now
+	}
+
+	c, ok := registerLimiter.clients[ea]
+	if !ok {
+		c = &rateClient{start: now}
+		registerLimiter.clients[ea] = c
+	}
+	if now.Sub(c.start) >= registerWindow {
+		c.start = now
+		c.count = 0
+	}
+
+	if c.count < registerLimit {
+		c.count++
+		c.rejected = 0
+		return true, 0
+	}
+
+	// Suggest twice the delay each time the client retries too early.
+	c.rejected++
+	retry := c.start.Add(registerWindow).Sub(now)
+	for i := 1; i < c.rejected && retry < maxRetryAfter; i++ {
+		retry *= 2
+	}
+	if retry > maxRetryAfter {
+		retry = maxRetryAfter
+	}
+	c.retryAt = now.Add(retry)
+	return false, retry
+}
+
+// tooManyRequests tells the client to back off for retry.
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retry time.Duration) {
+	seconds := int(math.Ceil(retry.Seconds()))
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	err := json.NewEncoder(w).Encode(struct {
+		Error         string `json:"error"`
+		Limit         int    `json:"limit"`
+		WindowSeconds int    `json:"window_seconds"`
+		RetryAfter    int    `json:"retry_after"`
+	}{"Too many registrations", registerLimit, int(registerWindow.Seconds()), seconds})
+	if err != nil {
+		writeFailed(r, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRegisterRateLimit(t *testing.T) {
+	forget("80.2.3.60", "80.2.3.61")
+	defer func(l int, w time.Duration) { registerLimit, registerWindow = l, w }(registerLimit, registerWindow)
+	registerLimit, registerWindow = 2, time.Minute
+
+	body := `{"name":"Testdevice","address":"192.168.100.220"}`
+	var token string
+	for i := 0; i < registerLimit; i++ {
+		rr := postToken(t, RegisterDevice, "80.2.3.60:321", token, body)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+		}
+		if i == 0 {
+			token = rr.Header().Get("X-Device-Token")
+		}
+	}
+
+	var last int
+	for i := 0; i < 3; i++ {
+		rr := postToken(t, RegisterDevice, "80.2.3.60:321", token, body)
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+		}
+		retry, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+		if err != nil || retry <= last {
+			t.Errorf("expected an increasing Retry-After, got %q after %d", rr.Header().Get("Retry-After"), last)
+		}
+		last = retry
+	}
+
+	// Other networks are not affected.
+	if rr := post(t, RegisterDevice, "80.2.3.61:321", body); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+}
+
+func TestRegisterLimiterSweepsRejected(t *testing.T) {
+	defer func(l int, w time.Duration) { registerLimit, registerWindow = l, w }(registerLimit, registerWindow)
+	registerLimit, registerWindow = 1, 10*time.Millisecond
+
+	allowRegister("80.2.3.117")
+	if ok, _ := allowRegister("80.2.3.117"); ok {
+		t.Fatal("expected the second registration to be rejected")
+	}
+
+	// Once the window and the suggested delay passed, the next sweep forgets it.
+	time.Sleep(50 * time.Millisecond)
+	allowRegister("80.2.3.118")
+
+	registerLimiter.Lock()
+	defer registerLimiter.Unlock()
+	if _, ok := registerLimiter.clients["80.2.3.117"]; ok {
+		t.Error("expected the rejected client to be swept")
+	}
+}
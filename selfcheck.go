@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SelfCheck answers the external address resolved for the request, for the
+// self-check to tell whether the proxy in front forwards the client address.
+func SelfCheck(w http.ResponseWriter, r *http.Request) {
+	ea, err := externalAddress(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if _, err := fmt.Fprint(w, ea); err != nil {
+		writeFailed(r, err)
+	}
+}
+
+// selfCheck requests /api/selfcheck from base, the public URL of the
+// service, so that the probe goes through the configured front, and checks
+// that the external address resolved from it is not loopback: the proxy
+// headers, or the PROXY protocol header with -proxy-protocol, are honored.
+func selfCheck(base string) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(base, "/") + "/api/selfcheck")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	ea := strings.TrimSpace(string(body))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the external address can't be resolved: %d %s", resp.StatusCode, ea)
+	}
+	if ip := net.ParseIP(ea); ip == nil || ip.IsLoopback() {
+		return fmt.Errorf("the external address resolves to %s, the proxy headers are not honored", ea)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// selfCheckIP is the client address forwarded by the test proxies, taken
+// from a range reserved for documentation (RFC 5737).
+const selfCheckIP = "203.0.113.7"
+
+func TestSelfCheck(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(SelfCheck))
+	defer service.Close()
+	target, _ := url.Parse(service.URL)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set("X-Real-IP", selfCheckIP)
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	if err := selfCheck(front.URL); err != nil {
+		t.Error(err)
+	}
+
+	// Without the proxy, the request comes from loopback without X-Real-IP.
+	if err := selfCheck(service.URL); err == nil {
+		t.Error("expected the self-check to fail without the proxy")
+	}
+}
+
+func TestSelfCheckProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := httptest.NewUnstartedServer(http.HandlerFunc(SelfCheck))
+	service.Listener.Close()
+	service.Listener = proxyListener{ln}
+	service.Start()
+	defer service.Close()
+	target, _ := url.Parse(service.URL)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			_, port, _ := net.SplitHostPort(addr)
+			fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 54321 %s\r\n", selfCheckIP, port)
+			return conn, nil
+		},
+	}
+	front := httptest.NewServer(proxy)
+	defer front.Close()
+
+	if err := selfCheck(front.URL); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type tenantKey struct{}
+
+// tenantOf returns the tenant the request was sent to, if any.
+func tenantOf(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+func allowedTenant(tenant string) bool {
+	for _, t := range strings.Split(tenants, ",") {
+		if t != "" && t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantHandler serves the public API of each allowed tenant under
+// /t/{tenant}/api/, with its devices kept apart from the other tenants.
+func TenantHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/t/"), "/")
+	if tenantOf(r) != "" || !allowedTenant(tenant) ||
+		!strings.HasPrefix(path, "api/") || strings.HasPrefix(path, "api/admin/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	r = r.Clone(context.WithValue(r.Context(), tenantKey{}, tenant))
+	r.URL.Path = "/" + path
+	r.URL.RawPath = ""
+	http.DefaultServeMux.ServeHTTP(w, r)
+}
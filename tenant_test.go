@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	forget("80.2.3.53")
+	defer func(s string) { tenants = s }(tenants)
+	tenants = "a,b"
+
+	// TenantHandler dispatches to the default mux.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/t/", TenantHandler)
+	mux.HandleFunc("/api/register", RegisterDevice)
+	mux.HandleFunc("/api/devices", ListDevices)
+	defer func(m *http.ServeMux) { http.DefaultServeMux = m }(http.DefaultServeMux)
+	http.DefaultServeMux = mux
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "80.2.3.53:321"
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve("POST", "/t/a/api/register", `{"name":"Tenant A","address":"192.168.100.242"}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v - %v", rr.Code, rr.Body)
+	}
+
+	if rr := serve("GET", "/t/a/api/devices", ""); !strings.Contains(rr.Body.String(), "Tenant A") {
+		t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+	}
+	for _, target := range []string{"/t/b/api/devices", "/api/devices"} {
+		if rr := serve("GET", target, ""); rr.Body.String() != "[]\n" {
+			t.Errorf("%s: handler returned unexpected body: got %v", target, rr.Body.String())
+		}
+	}
+	for _, target := range []string{"/t/c/api/devices", "/t/a/t/b/api/devices", "/t/a/"} {
+		if rr := serve("GET", target, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("%s: handler returned wrong status code: got %v", target, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// pendingWebhooks tracks the notifications still being delivered, so the
+// shutdown can wait for them.
+var (
+	pendingWebhooks sync.WaitGroup
+	pendingCount    int64
+)
+
+// webhooksClosed is set by closeWebhooks once the shutdown has begun, the
+// cleanup, the canary and the expiry hooks may still notify meanwhile but
+// nothing is added to pendingWebhooks while it's waited for.
+var webhooksClosed struct {
+	sync.Mutex
+	closed bool
+}
+
+// notify posts the event about the device to the configured webhook. The
+// delivery happens in the background, it is safe to call with the lock held.
+func notify(event string, d Device) {
+	if webhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Event           string `json:"event"`
+		ExternalAddress string `json:"externaladdress"`
+		Device          Device `json:"device"`
+	}{event, d.ExternalAddress, d})
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+	deliver(event, body)
+}
+
+// deliver posts the JSON body of the event to the webhook in the background.
+func deliver(event string, body []byte) {
+	webhooksClosed.Lock()
+	if webhooksClosed.closed {
+		webhooksClosed.Unlock()
+		log.Println("webhook:", event, "notification dropped, the service is shutting down")
+		return
+	}
+	pendingWebhooks.Add(1)
+	webhooksClosed.Unlock()
+	atomic.AddInt64(&pendingCount, 1)
+	go func() {
+		defer pendingWebhooks.Done()
+		defer atomic.AddInt64(&pendingCount, -1)
+
+		resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("webhook:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Println("webhook:", event, "notification returned", resp.Status)
+		}
+	}()
+}
+
+// closeWebhooks stops delivering new notifications, before the shutdown
+// waits for the pending ones.
+func closeWebhooks() {
+	webhooksClosed.Lock()
+	webhooksClosed.closed = true
+	webhooksClosed.Unlock()
+}
+
+// waitWebhooks waits for the pending notifications, or until ctx is done.
+// Once serving, closeWebhooks must be called first.
+func waitWebhooks(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		pendingWebhooks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println(atomic.LoadInt64(&pendingCount), "webhooks still pending")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	events := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n struct {
+			Event string `json:"event"`
+		}
+		json.NewDecoder(r.Body).Decode(&n)
+		events <- n.Event
+	}))
+	defer srv.Close()
+
+	defer func(u string) { webhookURL = u }(webhookURL)
+	webhookURL = srv.URL
+
+	notify("expired", Device{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.151"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waitWebhooks(ctx)
+
+	select {
+	case e := <-events:
+		if e != "expired" {
+			t.Errorf("webhook received %q, expected expired", e)
+		}
+	default:
+		t.Error("webhook was not delivered before waitWebhooks returned")
+	}
+}
+
+func TestNotifyAfterClose(t *testing.T) {
+	var delivered atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered.Store(true)
+	}))
+	defer srv.Close()
+
+	defer func(u string) { webhookURL = u }(webhookURL)
+	webhookURL = srv.URL
+	defer func() {
+		webhooksClosed.Lock()
+		webhooksClosed.closed = false
+		webhooksClosed.Unlock()
+	}()
+
+	closeWebhooks()
+	notify("expired", Device{ExternalAddress: "80.2.3.41", InternalAddress: "192.168.100.151"})
+	waitWebhooks(t.Context())
+	if delivered.Load() {
+		t.Error("expected no notification once the webhooks are closed")
+	}
+}